@@ -7,6 +7,7 @@ package apub
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -35,6 +36,9 @@ const PublicCollection string = "https://www.w3.org/ns/activitystreams#Public"
 
 var ErrNotExist = errors.New("no such activity")
 
+// ErrGone is returned when looking up an Activity which has been deleted.
+var ErrGone = errors.New("activity deleted")
+
 // Activity represents the Activity Streams Object core type.
 // See Activity Streams 2.0, section 4.1.
 type Activity struct {
@@ -50,8 +54,12 @@ type Activity struct {
 	To           []string   `json:"to,omitempty"`
 	CC           []string   `json:"cc,omitempty"`
 	Followers    string     `json:"followers,omitempty"`
+	Following    string     `json:"following,omitempty"`
 	InReplyTo    string     `json:"inReplyTo,omitempty"`
 	Published    *time.Time `json:"published,omitempty"`
+	Updated      *time.Time `json:"updated,omitempty"`
+	Deleted      *time.Time `json:"deleted,omitempty"`
+	FormerType   string     `json:"formerType,omitempty"`
 	AttributedTo string     `json:"attributedTo,omitempty"`
 	Content      string     `json:"content,omitempty"`
 	MediaType    string     `json:"mediaType,omitempty"`
@@ -64,6 +72,15 @@ type Activity struct {
 	Href      string     `json:"href,omitempty"`
 	Tag       []Activity `json:"tag,omitempty"`
 	Endpoints Endpoints  `json:"endpoints,omitempty"`
+	// AssertionMethod lists keys which an actor signs with.
+	// See FEP-521a.
+	AssertionMethod []Multikey `json:"assertionMethod,omitempty"`
+	// Attachment lists files, such as images, attached to an object.
+	Attachment []Attachment `json:"attachment,omitempty"`
+	// Context and Conversation identify the thread of a post.
+	// Conversation is used by Mastodon, Context by most others.
+	Context      string `json:"context,omitempty"`
+	Conversation string `json:"conversation,omitempty"`
 	// Contains a JSON-encoded Activity, or a URL as a JSON string
 	// pointing to an Activity. Use Activity.Unwrap() to access
 	// the enclosed, decoded value.
@@ -73,8 +90,10 @@ type Activity struct {
 func (act *Activity) UnmarshalJSON(b []byte) error {
 	type Alias Activity
 	aux := &struct {
-		AtContext interface{} `json:"@context"`
-		Object    interface{}
+		AtContext  interface{} `json:"@context"`
+		Object     interface{}
+		Attachment json.RawMessage `json:"attachment"`
+		Context    json.RawMessage `json:"context"`
 		*Alias
 	}{
 		Alias: (*Alias)(act),
@@ -90,6 +109,27 @@ func (act *Activity) UnmarshalJSON(b []byte) error {
 			act.AtContext = vv
 		}
 	}
+	// context may be an object, such as a collection of the thread's posts.
+	if len(aux.Context) > 0 && string(aux.Context) != "null" {
+		var obj struct {
+			ID string `json:"id"`
+		}
+		if err := json.Unmarshal(aux.Context, &act.Context); err != nil {
+			if err := json.Unmarshal(aux.Context, &obj); err != nil {
+				return fmt.Errorf("context: %w", err)
+			}
+			act.Context = obj.ID
+		}
+	}
+	// attachment may be a single object rather than a list.
+	if len(aux.Attachment) > 0 && string(aux.Attachment) != "null" {
+		if aux.Attachment[0] != '[' {
+			aux.Attachment = append(append([]byte("["), aux.Attachment...), ']')
+		}
+		if err := json.Unmarshal(aux.Attachment, &act.Attachment); err != nil {
+			return fmt.Errorf("attachment: %w", err)
+		}
+	}
 	return nil
 }
 
@@ -98,19 +138,39 @@ func (act *Activity) UnmarshalJSON(b []byte) error {
 // in which case the activity is looked up by client or by
 // apub.defaultClient if client is nil.
 func (act *Activity) Unwrap(client *Client) (*Activity, error) {
+	return act.UnwrapContext(context.Background(), client)
+}
+
+// UnwrapContext is like Unwrap but uses ctx for any lookup.
+func (act *Activity) UnwrapContext(ctx context.Context, client *Client) (*Activity, error) {
 	if act.Object == nil {
 		return nil, errors.New("no wrapped activity")
 	}
 
-	var buf io.Reader
-	buf = bytes.NewReader(act.Object)
-	if strings.HasPrefix(string(act.Object), "https") {
+	var id string
+	if err := json.Unmarshal(act.Object, &id); err == nil {
 		if client == nil {
-			return Lookup(string(act.Object))
+			client = &DefaultClient
 		}
-		return client.Lookup(string(act.Object))
+		return client.LookupContext(ctx, id)
+	}
+	return Decode(bytes.NewReader(act.Object))
+}
+
+// ObjectID returns the ID of the object of act,
+// whether the object is embedded or referenced by ID.
+func (act *Activity) ObjectID() string {
+	var id string
+	if err := json.Unmarshal(act.Object, &id); err == nil {
+		return id
+	}
+	var obj struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(act.Object, &obj); err == nil {
+		return obj.ID
 	}
-	return Decode(buf)
+	return ""
 }
 
 func Decode(r io.Reader) (*Activity, error) {
@@ -139,9 +199,13 @@ type Actor struct {
 	Inbox     string     `json:"inbox"`
 	Outbox    string     `json:"outbox"`
 	Followers string     `json:"followers"`
+	Following string     `json:"following,omitempty"`
 	Endpoints Endpoints  `json:"endpoints,omitempty"`
 	Published *time.Time `json:"published,omitempty"`
 	PublicKey PublicKey  `json:"publicKey"`
+	// AssertionMethod lists the keys, including PublicKey,
+	// which the Actor signs with. See FEP-521a.
+	AssertionMethod []Multikey `json:"assertionMethod,omitempty"`
 }
 
 type PublicKey struct {
@@ -1,6 +1,9 @@
 package apub
 
 import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path"
 	"reflect"
@@ -97,3 +100,34 @@ func TestInboxes(t *testing.T) {
 		t.Errorf("unexpected inbox slice of multiple actors, want %s got %s", want, got)
 	}
 }
+
+func TestObjectID(t *testing.T) {
+	tests := []struct {
+		object string
+		want   string
+	}{
+		{`"https://example.com/notes/1"`, "https://example.com/notes/1"},
+		{`{"id": "https://example.com/notes/1", "type": "Tombstone"}`, "https://example.com/notes/1"},
+		{`[1, 2]`, ""},
+	}
+	for _, tt := range tests {
+		a := &Activity{Type: "Delete", Object: []byte(tt.object)}
+		if got := a.ObjectID(); got != tt.want {
+			t.Errorf("object %s: got id %q, want %q", tt.object, got, tt.want)
+		}
+	}
+}
+
+func TestLookupGone(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", ContentType)
+		w.WriteHeader(http.StatusGone)
+		w.Write([]byte(`{"id": "https://example.com/notes/1", "type": "Tombstone"}`))
+	}))
+	defer srv.Close()
+	client := &Client{Client: srv.Client()}
+	_, err := client.Lookup(srv.URL + "/notes/1")
+	if !errors.Is(err, ErrGone) {
+		t.Errorf("want error %v, got %v", ErrGone, err)
+	}
+}
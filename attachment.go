@@ -0,0 +1,273 @@
+package apub
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/mail"
+	"net/textproto"
+	"path"
+	"strings"
+)
+
+// Attachment is a file, such as an image, attached to an object.
+// See Activity Streams 2.0, section 4.1 (attachment) and the Document type.
+type Attachment struct {
+	Type      string `json:"type"`
+	MediaType string `json:"mediaType,omitempty"`
+	URL       string `json:"url"`
+	// Name is a description of the file, such as alt text for an image.
+	Name     string `json:"name,omitempty"`
+	Blurhash string `json:"blurhash,omitempty"`
+	Width    int    `json:"width,omitempty"`
+	Height   int    `json:"height,omitempty"`
+	// Data is the content of the file, if read from a mail message
+	// or fetched for one. It is never encoded as JSON.
+	Data []byte `json:"-"`
+}
+
+func (a *Attachment) UnmarshalJSON(b []byte) error {
+	type Alias Attachment
+	aux := &struct {
+		URL json.RawMessage `json:"url"`
+		*Alias
+	}{
+		Alias: (*Alias)(a),
+	}
+	if err := json.Unmarshal(b, &aux); err != nil {
+		return err
+	}
+	if len(aux.URL) == 0 {
+		return nil
+	}
+	// url may be a string, a Link, or a list of either.
+	if err := json.Unmarshal(aux.URL, &a.URL); err == nil {
+		return nil
+	}
+	var links []json.RawMessage
+	if err := json.Unmarshal(aux.URL, &links); err != nil {
+		links = []json.RawMessage{aux.URL}
+	}
+	for _, l := range links {
+		var link struct {
+			Href      string `json:"href"`
+			MediaType string `json:"mediaType"`
+		}
+		if err := json.Unmarshal(l, &a.URL); err == nil {
+			return nil
+		} else if err := json.Unmarshal(l, &link); err == nil && link.Href != "" {
+			a.URL = link.Href
+			if a.MediaType == "" {
+				a.MediaType = link.MediaType
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("url: no link in %s", aux.URL)
+}
+
+// isMedia reports whether mediaType is that of an image, audio or video.
+func isMedia(mediaType string) bool {
+	typ, _, _ := strings.Cut(mediaType, "/")
+	switch typ {
+	case "image", "audio", "video":
+		return true
+	}
+	return false
+}
+
+// newAttachment returns an Attachment of data, the content of a MIME part
+// with the given media type and header.
+// The part's Content-Description is used as the attachment's name.
+func newAttachment(mediaType string, header textproto.MIMEHeader, data []byte) Attachment {
+	att := Attachment{
+		Type:      "Document",
+		MediaType: mediaType,
+		Data:      data,
+	}
+	if loc := header.Get("Content-Location"); strings.HasPrefix(loc, "https://") {
+		att.URL = loc
+	}
+	desc := header.Get("Content-Description")
+	if s, err := new(mime.WordDecoder).DecodeHeader(desc); err == nil {
+		desc = s
+	}
+	att.Name = strings.TrimSpace(desc)
+	if strings.HasPrefix(mediaType, "image/") {
+		att.Type = "Image"
+		if cfg, _, err := image.DecodeConfig(bytes.NewReader(data)); err == nil {
+			att.Width, att.Height = cfg.Width, cfg.Height
+		}
+	}
+	return att
+}
+
+// externalAttachment returns the Attachment referenced by
+// a message/external-body part with the URL access type (RFC 2017).
+func externalAttachment(params map[string]string, body io.Reader) (Attachment, error) {
+	if !strings.EqualFold(params["access-type"], "URL") {
+		return Attachment{}, fmt.Errorf("unsupported access-type %q", params["access-type"])
+	}
+	header, err := textproto.NewReader(bufio.NewReader(body)).ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return Attachment{}, fmt.Errorf("read external body header: %w", err)
+	}
+	mt, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	att := newAttachment(mt, header, nil)
+	att.URL = strings.ReplaceAll(params["url"], " ", "")
+	return att, nil
+}
+
+// attachMedia replaces the body of msg with a multipart/mixed body
+// of the original body followed by a part for each of attachments.
+func attachMedia(ctx context.Context, msg *mail.Message, attachments []Attachment, client *Client) error {
+	buf := &bytes.Buffer{}
+	w := multipart.NewWriter(buf)
+	ct := msg.Header.Get("Content-Type")
+	body, err := io.ReadAll(msg.Body)
+	if err != nil {
+		return err
+	}
+	var cte string
+	if !strings.HasPrefix(ct, "multipart/") {
+		cte, body = transferEncode(ct, body)
+	}
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Type", ct)
+	if cte != "" {
+		header.Set("Content-Transfer-Encoding", cte)
+	}
+	pw, err := w.CreatePart(header)
+	if err != nil {
+		return err
+	}
+	if _, err := pw.Write(body); err != nil {
+		return err
+	}
+	for i := range attachments {
+		if err := writeAttachment(ctx, w, &attachments[i], client); err != nil {
+			return fmt.Errorf("attachment %d: %w", i, err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	msg.Header["MIME-Version"] = []string{"1.0"}
+	msg.Header["Content-Type"] = []string{mime.FormatMediaType("multipart/mixed", map[string]string{"boundary": w.Boundary()})}
+	msg.Body = buf
+	return nil
+}
+
+// MaxAttachmentSize is the size in bytes of the largest attachment
+// included in mail messages. Larger attachments are only linked to.
+const MaxAttachmentSize = 8 << 20
+
+// writeAttachment writes att as a part to w.
+// If att has no data, it is fetched by client.
+// Attachments which cannot be fetched, are too big, or are not served over HTTPS,
+// are written as links in message/external-body parts instead.
+func writeAttachment(ctx context.Context, w *multipart.Writer, att *Attachment, client *Client) error {
+	data := att.Data
+	if data == nil && att.URL != "" {
+		var err error
+		data, err = client.fetchMedia(ctx, att.URL)
+		if err != nil {
+			data = nil
+		}
+	}
+	mediaType := att.MediaType
+	if mediaType == "" {
+		mediaType = "application/octet-stream"
+	}
+	var desc string
+	if att.Name != "" {
+		desc = mime.QEncoding.Encode("utf-8", att.Name)
+	}
+	if data == nil {
+		if att.URL == "" {
+			return nil
+		}
+		header := make(textproto.MIMEHeader)
+		header.Set("Content-Type", mime.FormatMediaType("message/external-body", map[string]string{"access-type": "URL", "url": att.URL}))
+		pw, err := w.CreatePart(header)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(pw, "Content-Type: %s\r\n", mediaType)
+		fmt.Fprintf(pw, "Content-Location: %s\r\n", att.URL)
+		if desc != "" {
+			fmt.Fprintf(pw, "Content-Description: %s\r\n", desc)
+		}
+		_, err = fmt.Fprint(pw, "\r\n")
+		return err
+	}
+
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Type", mediaType)
+	if desc != "" {
+		header.Set("Content-Description", desc)
+	}
+	cte, body := transferEncode(mediaType, data)
+	if cte != "" {
+		header.Set("Content-Transfer-Encoding", cte)
+	}
+	disp := map[string]string{}
+	if att.URL != "" {
+		header.Set("Content-Location", att.URL)
+		disp["filename"] = path.Base(att.URL)
+	}
+	header.Set("Content-Disposition", mime.FormatMediaType("inline", disp))
+	pw, err := w.CreatePart(header)
+	if err != nil {
+		return err
+	}
+	_, err = pw.Write(body)
+	return err
+}
+
+// fetchMedia returns the content of the file at url,
+// or an error if it is larger than MaxAttachmentSize.
+// Only HTTPS URLs are fetched; we shouldn't be made to fetch
+// from anywhere else on behalf of whoever sent the attachment.
+func (c *Client) fetchMedia(ctx context.Context, url string) ([]byte, error) {
+	if !strings.HasPrefix(url, "https://") {
+		return nil, fmt.Errorf("%s not served over https", url)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	hclient := c.Client
+	if hclient == nil {
+		hclient = http.DefaultClient
+	}
+	resp, err := hclient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return nil, newStatusError(resp)
+	}
+	if resp.ContentLength > MaxAttachmentSize {
+		return nil, fmt.Errorf("%s too large: %d bytes", url, resp.ContentLength)
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, MaxAttachmentSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > MaxAttachmentSize {
+		return nil, fmt.Errorf("%s too large: more than %d bytes", url, MaxAttachmentSize)
+	}
+	return b, nil
+}
@@ -0,0 +1,116 @@
+package apub
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestDecodeAttachment(t *testing.T) {
+	tests := []struct {
+		name string
+		json string
+		want Attachment
+	}{
+		{
+			"mastodon",
+			`{"attachment": [{"type": "Document", "mediaType": "image/png", "url": "https://example.com/a.png", "name": "a cat", "blurhash": "UBL_:rOpGG-oBUNG,qRj2so|=eE1w^n4S5NH", "width": 2, "height": 1}]}`,
+			Attachment{Type: "Document", MediaType: "image/png", URL: "https://example.com/a.png", Name: "a cat", Blurhash: "UBL_:rOpGG-oBUNG,qRj2so|=eE1w^n4S5NH", Width: 2, Height: 1},
+		},
+		{
+			"single link",
+			`{"attachment": {"type": "Video", "url": {"type": "Link", "href": "https://example.com/v.mp4", "mediaType": "video/mp4"}}}`,
+			Attachment{Type: "Video", MediaType: "video/mp4", URL: "https://example.com/v.mp4"},
+		},
+		{
+			"link list",
+			`{"attachment": [{"type": "Audio", "url": ["https://example.com/a.ogg"]}]}`,
+			Attachment{Type: "Audio", URL: "https://example.com/a.ogg"},
+		},
+	}
+	for _, tt := range tests {
+		var a Activity
+		if err := json.Unmarshal([]byte(tt.json), &a); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if len(a.Attachment) != 1 {
+			t.Errorf("%s: want 1 attachment, got %d", tt.name, len(a.Attachment))
+			continue
+		}
+		got := a.Attachment[0]
+		if got.Type != tt.want.Type || got.MediaType != tt.want.MediaType || got.URL != tt.want.URL || got.Name != tt.want.Name || got.Blurhash != tt.want.Blurhash || got.Width != tt.want.Width || got.Height != tt.want.Height {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAttachMedia(t *testing.T) {
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, image.NewGray(image.Rect(0, 0, 3, 2))); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/media/x.png":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(buf.Bytes())
+		case "/media/v.mp4":
+			w.Header().Set("Content-Length", strconv.Itoa(MaxAttachmentSize+1))
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	defer srv.Close()
+	attachments := []Attachment{
+		{Type: "Image", MediaType: "image/png", URL: srv.URL + "/media/x.png", Name: "a grey rectangle"},
+		{Type: "Document", MediaType: "video/mp4", URL: srv.URL + "/media/v.mp4", Name: "a very large video"},
+		{Type: "Image", MediaType: "image/png", URL: strings.Replace(srv.URL, "https", "http", 1) + "/media/x.png"},
+	}
+	msg := &mail.Message{
+		Header: mail.Header{"Content-Type": []string{"text/plain; charset=utf-8"}},
+		Body:   strings.NewReader("hello, world"),
+	}
+	client := &Client{Client: srv.Client()}
+	if err := attachMedia(context.Background(), msg, attachments, client); err != nil {
+		t.Fatal(err)
+	}
+
+	var media []Attachment
+	text, _, err := readText(textproto.MIMEHeader(msg.Header), msg.Body, &media)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(text) != "hello, world" {
+		t.Errorf("got text %q", text)
+	}
+	if len(media) != len(attachments) {
+		t.Fatalf("want %d attachments, got %d", len(attachments), len(media))
+	}
+	img := media[0]
+	if img.Type != "Image" || img.Name != attachments[0].Name || img.URL != attachments[0].URL {
+		t.Errorf("image attachment: got %+v", img)
+	}
+	if !bytes.Equal(img.Data, buf.Bytes()) {
+		t.Errorf("image data changed in transit")
+	}
+	if img.Width != 3 || img.Height != 2 {
+		t.Errorf("image dimensions: got %dx%d, want 3x2", img.Width, img.Height)
+	}
+	// too large, or not over https, so only linked to.
+	for _, i := range []int{1, 2} {
+		link := media[i]
+		if link.URL != attachments[i].URL || link.MediaType != attachments[i].MediaType || link.Data != nil {
+			t.Errorf("linked attachment: got %+v", link)
+		}
+	}
+}
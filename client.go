@@ -2,13 +2,15 @@ package apub
 
 import (
 	"bytes"
-	"crypto/rsa"
+	"context"
+	"crypto"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
-	"strings"
+	"strconv"
+	"time"
 )
 
 var DefaultClient Client = Client{Client: http.DefaultClient}
@@ -23,51 +25,61 @@ func LookupActor(id string) (*Actor, error) {
 
 type Client struct {
 	*http.Client
-	// Key is a RSA private key which will be used to sign requests.
-	Key *rsa.PrivateKey
+	// Key is a private key which will be used to sign requests.
+	// RSA and Ed25519 keys are supported.
+	Key crypto.Signer
 	// PubKeyID is a URL where the corresponding public key of Key
 	// may be accessed. This must be set if Key is also set.
 	PubKeyID string // actor.PublicKey.ID
+	// RFC9421Key, if set, is used instead of Key to sign requests
+	// using RFC9421, so that modern keys such as Ed25519 may be used
+	// while RSA keys are kept for servers only supporting Cavage.
+	// RFC9421KeyID is the URL of its public key.
+	RFC9421Key   crypto.Signer
+	RFC9421KeyID string
+	// Scheme is the scheme used to sign requests.
+	// If a server responds to a signed request with
+	// 401 Unauthorized, the request is retried once
+	// signed using the other scheme.
+	Scheme SignatureScheme
 }
 
 func (c *Client) Lookup(id string) (*Activity, error) {
-	if !strings.HasPrefix(id, "http") {
-		return nil, fmt.Errorf("id is not a HTTP URL")
-	}
-	if c.Client == nil {
-		c.Client = http.DefaultClient
-	}
+	return c.LookupContext(context.Background(), id)
+}
 
-	req, err := newRequest(http.MethodGet, id, nil, c.Key, c.PubKeyID)
-	if err != nil {
-		return nil, fmt.Errorf("new request: %w", err)
-	}
-	resp, err := c.Do(req)
+// LookupContext is like Lookup but uses ctx for the underlying HTTP request.
+func (c *Client) LookupContext(ctx context.Context, id string) (*Activity, error) {
+	body, err := c.get(ctx, id)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode == http.StatusNotFound {
-		return nil, ErrNotExist
-	} else if resp.StatusCode >= 400 {
-		return nil, fmt.Errorf("non-ok response status %s", resp.Status)
-	}
-	return Decode(resp.Body)
+	defer body.Close()
+	return Decode(body)
 }
 
 func (c *Client) LookupActor(id string) (*Actor, error) {
-	activity, err := c.Lookup(id)
+	return c.LookupActorContext(context.Background(), id)
+}
+
+// LookupActorContext is like LookupActor but uses ctx for the underlying HTTP request.
+func (c *Client) LookupActorContext(ctx context.Context, id string) (*Actor, error) {
+	activity, err := c.LookupContext(ctx, id)
 	if err != nil {
 		return nil, err
 	}
-	switch activity.Type {
+	if !isActor(activity.Type) {
+		return nil, fmt.Errorf("bad object Type %s", activity.Type)
+	}
+	return activityToActor(activity), nil
+}
+
+func isActor(typ string) bool {
+	switch typ {
 	case "Application", "Group", "Organization", "Person", "Service":
-		return activityToActor(activity), nil
-	case "Collection", "OrderedCollection":
-		// probably followers. let caller work out what it wants to do
-		return activityToActor(activity), nil
+		return true
 	}
-	return nil, fmt.Errorf("bad object Type %s", activity.Type)
+	return false
 }
 
 func activityToActor(activity *Activity) *Actor {
@@ -80,6 +92,7 @@ func activityToActor(activity *Activity) *Actor {
 		Inbox:     activity.Inbox,
 		Outbox:    activity.Outbox,
 		Followers: activity.Followers,
+		Following: activity.Following,
 		Published: activity.Published,
 		Summary:   activity.Summary,
 		Endpoints: activity.Endpoints,
@@ -87,36 +100,111 @@ func activityToActor(activity *Activity) *Actor {
 	if activity.PublicKey != nil {
 		actor.PublicKey = *activity.PublicKey
 	}
+	actor.AssertionMethod = activity.AssertionMethod
 	return actor
 }
 
 func (c *Client) Send(inbox string, activity *Activity) (*Activity, error) {
+	return c.SendContext(context.Background(), inbox, activity)
+}
+
+// SendContext is like Send but uses ctx for the underlying HTTP request.
+func (c *Client) SendContext(ctx context.Context, inbox string, activity *Activity) (*Activity, error) {
 	b, err := json.Marshal(activity)
 	if err != nil {
 		return nil, fmt.Errorf("encode outgoing activity: %w", err)
 	}
-	req, err := newRequest(http.MethodPost, inbox, bytes.NewReader(b), c.Key, c.PubKeyID)
-	if err != nil {
-		return nil, err
-	}
-	resp, err := c.Do(req)
+	resp, err := c.do(ctx, http.MethodPost, inbox, b)
 	if err != nil {
 		return nil, err
 	}
+	defer resp.Body.Close()
 	switch resp.StatusCode {
 	case http.StatusOK, http.StatusAccepted, http.StatusNoContent:
 		return nil, nil
 	case http.StatusNotFound:
-		return nil, fmt.Errorf("no such inbox %s", inbox)
+		return nil, fmt.Errorf("no such inbox %s: %w", inbox, newStatusError(resp))
 	default:
 		io.Copy(os.Stderr, resp.Body)
-		resp.Body.Close()
-		return nil, fmt.Errorf("non-ok response status %s", resp.Status)
+		return nil, newStatusError(resp)
 	}
 }
 
-func newRequest(method, url string, body io.Reader, key *rsa.PrivateKey, pubkeyURL string) (*http.Request, error) {
-	req, err := http.NewRequest(method, url, body)
+// StatusError is returned when a server responds
+// with an unexpected HTTP status.
+type StatusError struct {
+	StatusCode int
+	Status     string
+	// RetryAfter is how long the server asked us to wait
+	// before trying again, if at all.
+	RetryAfter time.Duration
+}
+
+func newStatusError(resp *http.Response) *StatusError {
+	serr := &StatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+	if v := resp.Header.Get("Retry-After"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			serr.RetryAfter = time.Duration(n) * time.Second
+		} else if t, err := http.ParseTime(v); err == nil {
+			serr.RetryAfter = time.Until(t)
+		}
+	}
+	return serr
+}
+
+func (e *StatusError) Error() string {
+	return "non-ok response status " + e.Status
+}
+
+// Temporary reports whether the request may succeed if retried later.
+// Server errors, timeouts and rate limiting are temporary;
+// other client errors such as 404 Not Found or 410 Gone are not.
+func (e *StatusError) Temporary() bool {
+	switch e.StatusCode {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return true
+	}
+	return e.StatusCode >= 500
+}
+
+// do sends a request signed with c's key, if any.
+// If the server responds with 401 Unauthorized, the request is
+// sent again signed using the other signature scheme.
+// This is sometimes called a "double-knock".
+func (c *Client) do(ctx context.Context, method, url string, body []byte) (*http.Response, error) {
+	if c.Client == nil {
+		c.Client = http.DefaultClient
+	}
+	resp, err := c.send(ctx, method, url, body, c.Scheme)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || c.Key == nil {
+		return resp, err
+	}
+	resp.Body.Close()
+	other := RFC9421
+	if c.Scheme == RFC9421 {
+		other = Cavage
+	}
+	return c.send(ctx, method, url, body, other)
+}
+
+func (c *Client) send(ctx context.Context, method, url string, body []byte, scheme SignatureScheme) (*http.Response, error) {
+	key, keyID := c.Key, c.PubKeyID
+	if scheme == RFC9421 && c.RFC9421Key != nil {
+		key, keyID = c.RFC9421Key, c.RFC9421KeyID
+	}
+	req, err := newRequest(ctx, method, url, body, key, keyID, scheme)
+	if err != nil {
+		return nil, fmt.Errorf("new request: %w", err)
+	}
+	return c.Do(req)
+}
+
+func newRequest(ctx context.Context, method, url string, body []byte, key crypto.Signer, pubkeyURL string, scheme SignatureScheme) (*http.Request, error) {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, r)
 	if err != nil {
 		return nil, err
 	}
@@ -124,10 +212,19 @@ func newRequest(method, url string, body io.Reader, key *rsa.PrivateKey, pubkeyU
 	if body != nil {
 		req.Header.Set("Content-Type", ContentType)
 	}
-	if key != nil {
-		if err := Sign(req, key, pubkeyURL); err != nil {
-			return nil, fmt.Errorf("sign request: %w", err)
-		}
+	if key == nil {
+		return req, nil
+	}
+	switch scheme {
+	case Cavage:
+		err = Sign(req, key, pubkeyURL)
+	case RFC9421:
+		err = SignRFC9421(req, key, pubkeyURL)
+	default:
+		err = fmt.Errorf("unknown signature scheme %s", scheme)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("sign request: %w", err)
 	}
 	return req, nil
 }
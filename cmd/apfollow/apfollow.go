@@ -0,0 +1,186 @@
+// Command apfollow follows, or stops following, ActivityPub Actors.
+//
+// Its usage is:
+//
+//	apfollow [-u] address ...
+//	apfollow -l
+//
+// Each address, such as "alex@apub.example.com",
+// is resolved to an Actor using WebFinger.
+// A Follow of the Actor is then sent on behalf of the current user,
+// and recorded as pending until apserve receives
+// the Actor's Accept or Reject.
+//
+// The flags understood are:
+//
+//	-u
+//		Unfollow each Actor by sending an Undo of the earlier Follow.
+//	-l
+//		List the Actors the current user has asked to follow,
+//		and whether each request is pending, accepted or rejected.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"time"
+
+	"olowe.co/apub"
+	"olowe.co/apub/internal/sys"
+)
+
+var uflag, lflag bool
+
+func init() {
+	log.SetFlags(0)
+	log.SetPrefix("apfollow: ")
+	flag.BoolVar(&uflag, "u", false, "unfollow")
+	flag.BoolVar(&lflag, "l", false, "list follows")
+	flag.Parse()
+}
+
+const usage = "apfollow [-u] address ... | apfollow -l"
+
+const sysName string = "apubtest2.srcbeat.com"
+
+const timeout = 30 * time.Second
+
+func main() {
+	if lflag && (uflag || len(flag.Args()) > 0) || !lflag && len(flag.Args()) == 0 {
+		log.Fatalln("usage:", usage)
+	}
+	current, err := user.Current()
+	if err != nil {
+		log.Fatal(err)
+	}
+	requests, err := sys.OpenFollowRequests(current.Username)
+	if err != nil {
+		log.Fatalf("open follow requests: %v", err)
+	}
+	if lflag {
+		if err := list(requests); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	me, err := sys.Actor(current.Username, sysName)
+	if err != nil {
+		log.Fatalf("load actor: %v", err)
+	}
+	client, err := sys.ClientFor(current.Username, sysName)
+	if err != nil {
+		log.Fatalf("activitypub client for %s: %v", current.Username, err)
+	}
+	var failed bool
+	for _, addr := range flag.Args() {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		if uflag {
+			err = unfollow(ctx, client, me, requests, addr)
+		} else {
+			err = follow(ctx, client, me, requests, addr)
+		}
+		cancel()
+		if err != nil {
+			log.Printf("%s: %v", addr, err)
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func list(requests *sys.FollowRequests) error {
+	reqs, err := requests.All()
+	if err != nil {
+		return fmt.Errorf("read follow requests: %w", err)
+	}
+	for _, req := range reqs {
+		fmt.Printf("%-8s %s\n", req.Status, req.Object)
+	}
+	return nil
+}
+
+// follow sends a Follow of the Actor at addr from me,
+// recording the request as pending.
+func follow(ctx context.Context, client *apub.Client, me *apub.Actor, requests *sys.FollowRequests, addr string) error {
+	them, err := client.FingerContext(ctx, addr)
+	if err != nil {
+		return fmt.Errorf("finger: %w", err)
+	}
+	object, err := json.Marshal(them.ID)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	activity := &apub.Activity{
+		AtContext: apub.NormContext,
+		ID:        fmt.Sprintf("%s/follow-%d", me.Outbox, now.UnixNano()),
+		Type:      "Follow",
+		Actor:     me.ID,
+		To:        []string{them.ID},
+		Published: &now,
+		Object:    object,
+	}
+	username := me.Username
+	if err := sys.AppendToOutbox(username, activity); err != nil {
+		return fmt.Errorf("append to outbox: %w", err)
+	}
+	// Record the request before delivery so that a prompt Accept is not missed.
+	req := &sys.FollowRequest{Object: them.ID, Follow: activity, Status: sys.FollowPending}
+	if err := requests.Put(req); err != nil {
+		return fmt.Errorf("record follow request: %w", err)
+	}
+	return sys.Deliver(ctx, client, username, them.Inbox, activity)
+}
+
+// unfollow sends an Undo of the earlier Follow by me of the Actor at addr,
+// then forgets the Actor.
+func unfollow(ctx context.Context, client *apub.Client, me *apub.Actor, requests *sys.FollowRequests, addr string) error {
+	them, err := client.FingerContext(ctx, addr)
+	if err != nil {
+		return fmt.Errorf("finger: %w", err)
+	}
+	req, err := requests.Get(them.ID)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("not following %s", them.ID)
+	} else if err != nil {
+		return fmt.Errorf("load follow request: %w", err)
+	}
+	object, err := json.Marshal(req.Follow)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	undo := &apub.Activity{
+		AtContext: apub.NormContext,
+		ID:        req.Follow.ID + "-undo",
+		Type:      "Undo",
+		Actor:     me.ID,
+		To:        []string{them.ID},
+		Published: &now,
+		Object:    object,
+	}
+	username := me.Username
+	if err := sys.AppendToOutbox(username, undo); err != nil {
+		return fmt.Errorf("append to outbox: %w", err)
+	}
+	if err := sys.Deliver(ctx, client, username, them.Inbox, undo); err != nil {
+		return err
+	}
+	following, err := sys.OpenFollowing(username)
+	if err != nil {
+		return err
+	}
+	if err := following.Remove(them.ID); err != nil {
+		return fmt.Errorf("remove from following: %w", err)
+	}
+	return requests.Remove(them.ID)
+}
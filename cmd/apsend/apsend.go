@@ -2,7 +2,9 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -10,7 +12,6 @@ import (
 	"net/mail"
 	"os"
 	"os/user"
-	"path"
 	"strconv"
 	"strings"
 	"time"
@@ -19,18 +20,7 @@ import (
 	"olowe.co/apub/internal/sys"
 )
 
-const usage string = "apsend [-F] [-t] rcpt ..."
-
-// Delivers the mail message to the user's Maildir.
-func deliverLocal(username string, msg []byte) error {
-	u, err := user.Lookup(username)
-	if err != nil {
-		return err
-	}
-	inbox := path.Join(u.HomeDir, "Maildir/new")
-	fname := fmt.Sprintf("%s/%d", inbox, time.Now().Unix())
-	return os.WriteFile(fname, msg, 0664)
-}
+const usage string = "apsend [-F] [-r] [-t] rcpt ..."
 
 func wrapCreate(activity *apub.Activity) (*apub.Activity, error) {
 	b, err := json.Marshal(activity)
@@ -49,9 +39,28 @@ func wrapCreate(activity *apub.Activity) (*apub.Activity, error) {
 	}, nil
 }
 
+// wrapUpdate returns an Update of activity, an edit of an earlier object.
+func wrapUpdate(activity *apub.Activity) (*apub.Activity, error) {
+	b, err := json.Marshal(activity)
+	if err != nil {
+		return nil, err
+	}
+	return &apub.Activity{
+		AtContext: activity.AtContext,
+		ID:        fmt.Sprintf("%s-update-%d", activity.ID, activity.Updated.Unix()),
+		Actor:     activity.AttributedTo,
+		Type:      "Update",
+		Published: activity.Updated,
+		To:        activity.To,
+		CC:        activity.CC,
+		Object:    b,
+	}, nil
+}
+
 var jflag bool
 var tflag bool
 var Fflag bool
+var rflag bool
 
 func init() {
 	log.SetFlags(0)
@@ -59,16 +68,46 @@ func init() {
 	flag.BoolVar(&Fflag, "F", false, "file a copy for the sender")
 	flag.BoolVar(&tflag, "t", false, "read recipients from message")
 	flag.BoolVar(&jflag, "j", false, "read ActivityPub JSON")
+	flag.BoolVar(&rflag, "r", false, "respond to pending follow requests")
 	flag.Parse()
 }
 
 const sysName string = "apubtest2.srcbeat.com"
 
+// timeout is the maximum duration of each request to a remote server.
+const timeout = 30 * time.Second
+
+// respondFollow accepts or rejects a follow request pending
+// approval by the named user if msg is the user's reply to one,
+// reporting whether it was.
+func respondFollow(msg *mail.Message, username string) (bool, error) {
+	pending, err := sys.OpenPending(username)
+	if err != nil {
+		return false, nil
+	}
+	follow, accept, err := pending.Response(msg, username+"@"+sysName)
+	if err != nil {
+		return true, err
+	} else if follow == nil {
+		return false, nil
+	}
+	client, err := sys.ClientFor(username, sysName)
+	if err != nil {
+		return true, fmt.Errorf("activitypub client for %s: %w", username, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := sys.RespondFollow(ctx, client, username, sysName, follow, accept); err != nil {
+		return true, err
+	}
+	return true, pending.Remove(follow.ID)
+}
+
 func main() {
-	if tflag {
-		log.Fatal("flag -t not implemented yet")
+	if tflag && jflag {
+		log.Fatal("flags -t and -j are mutually exclusive")
 	}
-	if len(flag.Args()) == 0 {
+	if len(flag.Args()) == 0 && !tflag {
 		fmt.Fprintln(os.Stderr, "usage:", usage)
 		os.Exit(1)
 	}
@@ -84,6 +123,7 @@ func main() {
 
 	var activity *apub.Activity
 	var bmsg []byte
+	rcpts := flag.Args()
 	if jflag {
 		activity, err = apub.Decode(os.Stdin)
 		if err != nil {
@@ -98,7 +138,31 @@ func main() {
 		if err != nil {
 			log.Fatal(err)
 		}
-		activity, err = apub.UnmarshalMail(msg, client)
+		// Only the user's own submissions may respond to follow requests;
+		// mail relayed by apserve is delivered as is.
+		if rflag {
+			handled, err := respondFollow(msg, current.Username)
+			if err != nil {
+				log.Fatalln("respond to follow request:", err)
+			} else if handled {
+				return
+			}
+		}
+		if tflag {
+			addrs, err := sys.HeaderRecipients(msg.Header, sysName)
+			if err != nil {
+				log.Fatalln("read recipients from message:", err)
+			}
+			rcpts = append(rcpts, addrs...)
+		}
+		// Blind copies must not be revealed to any recipient.
+		if msg.Header.Get("Bcc") != "" {
+			bmsg = sys.StripHeader(bmsg, "Bcc")
+			delete(msg.Header, "Bcc")
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		activity, err = apub.UnmarshalMailContext(ctx, msg, client)
+		cancel()
 		if err != nil {
 			log.Fatalln("unmarshal activity from message:", err)
 		}
@@ -106,9 +170,16 @@ func main() {
 
 	var remote []string
 	var gotErr bool
-	for _, rcpt := range flag.Args() {
+	// failures are reported back to the sender as a bounce message.
+	var failures []sys.Failure
+	seen := make(map[string]bool)
+	for _, rcpt := range rcpts {
+		if seen[rcpt] {
+			continue
+		}
+		seen[rcpt] = true
 		if !strings.Contains(rcpt, "@") {
-			if err := deliverLocal(rcpt, bmsg); err != nil {
+			if err := sys.DeliverLocal(rcpt, bmsg); err != nil {
 				gotErr = true
 				log.Printf("local delivery to %s: %v", rcpt, err)
 			}
@@ -117,12 +188,20 @@ func main() {
 		remote = append(remote, rcpt)
 	}
 	if len(remote) > 0 {
-		if !strings.HasPrefix(activity.AttributedTo, "https://"+sysName) {
-			log.Fatalln("cannot send activity from non-local actor", activity.AttributedTo)
+		// Objects such as Notes are sent wrapped in a Create,
+		// while activities such as Delete are sent as they are.
+		sender := activity.AttributedTo
+		if activity.Actor != "" {
+			sender = activity.Actor
 		}
-		from, err := client.LookupActor(activity.AttributedTo)
+		if !strings.HasPrefix(sender, "https://"+sysName) {
+			log.Fatalln("cannot send activity from non-local actor", sender)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		from, err := client.LookupActorContext(ctx, sender)
+		cancel()
 		if err != nil {
-			log.Fatalf("lookup actor %s: %v", activity.AttributedTo, err)
+			log.Fatalf("lookup actor %s: %v", sender, err)
 		}
 		// everything we do from here onwards is on behalf of the sender,
 		// so outbound requests must be signed with the sender's key.
@@ -131,53 +210,155 @@ func main() {
 			log.Fatalf("activitypub client for %s: %v", from.Username, err)
 		}
 
+		if activity.Published == nil {
+			now := time.Now()
+			activity.Published = &now
+		}
+		// Attachments read from the message are served by apserve.
+		for i := range activity.Attachment {
+			if activity.Attachment[i].Data == nil {
+				continue
+			}
+			if err := sys.StoreMedia(from.Username, sysName, &activity.Attachment[i]); err != nil {
+				log.Fatalf("store attachment %d: %v", i, err)
+			}
+		}
 		// overwrite auto generated ID from mail clients
 		if !strings.HasPrefix(activity.ID, "https://") {
 			activity.ID = from.Outbox + "/" + strconv.Itoa(int(activity.Published.Unix()))
-			bmsg, err = apub.MarshalMail(activity, client)
-			if err != nil {
-				log.Fatalf("remarshal %s activity to mail: %v", activity.Type, err)
+			if activity.Actor == "" {
+				ctx, cancel := context.WithTimeout(context.Background(), timeout)
+				bmsg, err = apub.MarshalMailContext(ctx, activity, client, nil)
+				cancel()
+				if err != nil {
+					log.Fatalf("remarshal %s activity to mail: %v", activity.Type, err)
+				}
 			}
 		}
 
-		// Permit this activity for the public, too;
-		// let's not pretend the fediverse is not public access.
-		activity.To = append(activity.To, apub.PublicCollection)
-		create, err := wrapCreate(activity)
-		if err != nil {
-			log.Fatalf("wrap %s %s in Create activity: %v", activity.Type, activity.ID, err)
-		}
-
-		// append outbound activities to the user's outbox so others can fetch it.
-		if err := sys.AppendToOutbox(from.Username, activity, create); err != nil {
-			log.Fatalf("append activities to outbox: %v", err)
+		outbound := activity
+		if activity.Actor == "" {
+			// Permit this activity for the public, too;
+			// let's not pretend the fediverse is not public access.
+			activity.To = append(activity.To, apub.PublicCollection)
+			if activity.Updated != nil {
+				orig, err := sys.OutboxObject(from.Username, activity.ID)
+				if err != nil {
+					log.Fatalf("edit %s: %v", activity.ID, err)
+				}
+				if orig.Type == "Tombstone" || orig.AttributedTo != activity.AttributedTo {
+					log.Fatalf("edit %s: not an object by %s", activity.ID, activity.AttributedTo)
+				}
+				activity.Published = orig.Published
+				// The original Create stays in the outbox as the post's history.
+				outbound, err = wrapUpdate(activity)
+				if err != nil {
+					log.Fatalf("wrap %s %s in Update activity: %v", activity.Type, activity.ID, err)
+				}
+			} else {
+				outbound, err = wrapCreate(activity)
+				if err != nil {
+					log.Fatalf("wrap %s %s in Create activity: %v", activity.Type, activity.ID, err)
+				}
+			}
+			// append outbound activities to the user's outbox so others can fetch it.
+			if err := sys.AppendToOutbox(from.Username, activity, outbound); err != nil {
+				log.Fatalf("append activities to outbox: %v", err)
+			}
+		} else {
+			if activity.Type == "Delete" {
+				if err := sys.TombstoneOutbox(from.Username, activity); err != nil {
+					log.Fatalf("delete object from outbox: %v", err)
+				}
+			}
+			if err := sys.AppendToOutbox(from.Username, activity); err != nil {
+				log.Fatalf("append activity to outbox: %v", err)
+			}
 		}
 
 		var actors []apub.Actor
 		for _, rcpt := range remote {
-			if strings.Contains(rcpt, "+followers") {
-				rcpt = strings.Replace(rcpt, "+followers", "", 1)
+			name, host, _ := strings.Cut(rcpt, "@")
+			if strings.HasSuffix(name, "+followers") {
+				// Only the owner of a followers collection knows its members.
+				// Other collections are addressed in the activity,
+				// and delivered by their owners on our behalf.
+				if host != sysName || strings.TrimSuffix(name, "+followers") != from.Username {
+					continue
+				}
+				followers, err := sys.OpenFollowers(from.Username)
+				if err != nil {
+					log.Fatalf("open followers of %s: %v", from.Username, err)
+				}
+				a, err := followers.Actors()
+				if err != nil {
+					log.Printf("read followers of %s: %v", from.Username, err)
+					gotErr = true
+					failures = append(failures, sys.Failure{Recipient: rcpt, Err: err})
+					continue
+				}
+				actors = append(actors, a...)
+				continue
 			}
-			a, err := client.Finger(rcpt)
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			a, err := client.FingerContext(ctx, rcpt)
+			cancel()
 			if err != nil {
 				log.Printf("webfinger %s: %v", rcpt, err)
 				gotErr = true
+				failures = append(failures, sys.Failure{Recipient: rcpt, Err: err})
 				continue
 			}
 			actors = append(actors, *a)
 		}
+		// Queue each delivery before attempting it, so that any
+		// temporary failures are retried later by apserve.
+		queue, err := sys.OpenQueue(from.Username)
+		if err != nil {
+			log.Fatalf("open delivery queue for %s: %v", from.Username, err)
+		}
+		var items []*sys.QueueItem
+		var inboxes []string
 		for _, inbox := range apub.Inboxes(actors) {
-			if _, err = client.Send(inbox, create); err != nil {
-				log.Printf("send %s %s to %s: %v", activity.Type, activity.ID, inbox, err)
+			item, err := queue.Enqueue(inbox, outbound, bmsg)
+			if err != nil {
+				log.Printf("queue %s %s for %s: %v", activity.Type, activity.ID, inbox, err)
 				gotErr = true
+				continue
+			}
+			if err := queue.Claim(item); err != nil {
+				log.Printf("claim queued delivery to %s: %v", inbox, err)
+				continue
+			}
+			items = append(items, item)
+			inboxes = append(inboxes, inbox)
+		}
+		fanout := &apub.Fanout{Client: client, Timeout: timeout}
+		deliveries := fanout.Send(context.Background(), outbound, inboxes)
+		for i, d := range deliveries {
+			err := queue.Done(items[i], d.Err)
+			if errors.Is(err, sys.ErrUndeliverable) {
+				log.Printf("send %s %s to %s: %v", activity.Type, activity.ID, d.Inbox, err)
+				gotErr = true
+				failures = append(failures, sys.Failure{Recipient: d.Inbox, Err: err})
+			} else if err != nil {
+				log.Printf("send %s %s to %s: %v (queued for retry)", activity.Type, activity.ID, d.Inbox, err)
 			}
 		}
 		if Fflag {
-			if err := deliverLocal(from.Username, bmsg); err != nil {
+			if err := sys.DeliverLocal(from.Username, bmsg); err != nil {
 				log.Printf("file copy for %s: %v", from.Username, err)
 				gotErr = true
 			}
 		}
+		if len(failures) > 0 {
+			dsn, err := sys.Bounce(sysName, from.Username+"@"+sysName, bmsg, failures)
+			if err != nil {
+				log.Printf("create bounce message: %v", err)
+			} else if err := sys.DeliverLocal(from.Username, dsn); err != nil {
+				log.Printf("deliver bounce message to %s: %v", from.Username, err)
+			}
+		}
 	}
 
 	if gotErr {
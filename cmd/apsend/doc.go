@@ -4,18 +4,59 @@ and disposes of it based on the provided recipient addresses.
 
 Its usage is:
 
-	apsend [ -F ] [ -t ] rcpt ...
+	apsend [ -F ] [ -r ] [ -t ] rcpt ...
 
 Messages are disposed of in one of two ways:
 
   - If the recipient refers to a local user, the message is appended to their local mailbox.
   - If the recipients refers to a remote user or collection, the message is sent via ActivityPub to each recipent's corresponding Actor inbox.
 
+Each remote delivery is first written to a queue in the sender's data directory.
+Deliveries are then attempted concurrently,
+with only a few requests in flight to any one server at a time.
+If a delivery fails temporarily, such as when the remote server is down,
+it is left in the queue and retried by [apserve] with exponential backoff.
+Deliveries still failing after 5 days, or failing permanently,
+are moved to the queue's "dead" directory.
+The sender is then notified by a bounce message:
+a delivery status notification (RFC 3464) quoting the original message,
+delivered to the sender's Maildir.
+Recipients which cannot be resolved with WebFinger are bounced immediately.
+
 Local recipients are addrsessed as a plain username such as "otl".
 Remote recipients are addressed as an email address,
 such as
 "mort@novum.streats.dev" or
 "otl+followers@hachyderm.io".
+A message addressed to the sender's own followers,
+such as "otl+followers@apubtest2.srcbeat.com",
+is delivered to the inbox of each follower recorded in the sender's data directory.
+Followers collections of other actors are only addressed in the activity;
+it is up to their owner to forward it.
+
+A message with a Supersedes: line referencing one of the sender's
+earlier messages is sent as an Update of the original post.
+
+A reply with the subject "+1" and no text of its own is sent as a Like of the post.
+Other reactions are requested with the X-Activity-Type: line of a reply,
+which may be Like, Dislike or Announce (a boost).
+For example, to boost a post to the sender's followers:
+
+	From: otl@apubtest2.srcbeat.com
+	To: alex@apub.example.com
+	CC: otl+followers@apubtest2.srcbeat.com
+	In-Reply-To: <https://apub.example.com/notes/1>
+	X-Activity-Type: Announce
+
+Activities read as JSON with the -j flag, such as Follow or Delete,
+are sent as they are rather than wrapped in a Create.
+Sending a Delete of one of the sender's objects
+also replaces the object in their outbox with a Tombstone.
+
+With the -r flag, the sender's reply to a follow request
+held for approval by [apserve]
+accepts or rejects the request instead of being sent.
+The first line of the reply must begin with "accept" or "reject".
 
 apsend is not intended to be executed directly by users.
 Usually it is executed as a mailer by a SMTP server like [apsubmit],
@@ -25,7 +66,15 @@ The flags understood are:
 
   - *-F* File a copy to the sender's mailbox.
 
-  - *-t* Read recipients from the To: and CC: lines of the message.
+  - *-j* Read an ActivityPub activity encoded as JSON instead of a mail message.
+
+  - *-r* Respond to follow requests held for approval.
+    Only messages submitted by the user themselves, such as by [apsubmit], should be read with -r;
+    a follower's own reply to their request must not approve it.
+
+  - *-t* Read recipients from the To:, CC: and Bcc: lines of the message,
+    in addition to any given as arguments.
+    The Bcc: line is removed before the message is sent.
 
 # Example
 
@@ -39,5 +88,9 @@ Given the following message in the file greeting.eml:
 Send it with the following command:
 
 	apsend otl@hachyderm.io < greeting.eml
+
+or, reading the recipient from the message:
+
+	apsend -t < greeting.eml
 */
 package main
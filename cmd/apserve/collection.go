@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"olowe.co/apub"
+	"olowe.co/apub/internal/sys"
+)
+
+// pageSize is the number of items in each page of a collection.
+const pageSize = 50
+
+// serveCollection serves items as the OrderedCollection id.
+// The collection itself has no items;
+// they are served in pages requested by the "page" query parameter.
+// If hidden is true, only the number of items is served.
+func serveCollection(w http.ResponseWriter, req *http.Request, id string, items []interface{}, hidden bool) {
+	npages := (len(items) + pageSize - 1) / pageSize
+	if npages == 0 {
+		npages = 1
+	}
+	pageURL := func(n int) string {
+		return fmt.Sprintf("%s?page=%d", id, n)
+	}
+
+	c := &apub.Collection{
+		AtContext:  apub.NormContext,
+		ID:         id,
+		Type:       "OrderedCollection",
+		TotalItems: len(items),
+	}
+	if req.URL.Query().Get("page") == "" || hidden {
+		if !hidden {
+			c.First = pageURL(1)
+			c.Last = pageURL(npages)
+		}
+	} else {
+		n, err := strconv.Atoi(req.URL.Query().Get("page"))
+		if err != nil || n < 1 || n > npages {
+			http.Error(w, "no such page", http.StatusNotFound)
+			return
+		}
+		c.ID = pageURL(n)
+		c.Type = "OrderedCollectionPage"
+		c.PartOf = id
+		if n > 1 {
+			c.Prev = pageURL(n - 1)
+		}
+		if n < npages {
+			c.Next = pageURL(n + 1)
+		}
+		start := (n - 1) * pageSize
+		end := start + pageSize
+		if end > len(items) {
+			end = len(items)
+		}
+		for _, item := range items[start:end] {
+			b, err := json.Marshal(item)
+			if err != nil {
+				log.Printf("encode item of %s: %v", id, err)
+				stat := http.StatusInternalServerError
+				http.Error(w, http.StatusText(stat), stat)
+				return
+			}
+			c.OrderedItems = append(c.OrderedItems, b)
+		}
+	}
+	w.Header().Set("Content-Type", apub.ContentType)
+	if err := json.NewEncoder(w).Encode(c); err != nil {
+		log.Printf("encode collection %s: %v", id, err)
+	}
+}
+
+// serveFollows serves the collection of Actors following, or followed by,
+// username as read from the set opened by open.
+// Most recently added Actors are listed first.
+func serveFollows(username, name string, open func(username string) (*sys.ActorSet, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet && req.Method != http.MethodHead {
+			stat := http.StatusMethodNotAllowed
+			http.Error(w, http.StatusText(stat), stat)
+			return
+		}
+		set, err := open(username)
+		if err != nil {
+			log.Printf("open %s of %s: %v", name, username, err)
+			http.Error(w, "no such collection", http.StatusNotFound)
+			return
+		}
+		actors, err := set.Actors()
+		if err != nil {
+			log.Printf("read %s of %s: %v", name, username, err)
+			stat := http.StatusInternalServerError
+			http.Error(w, http.StatusText(stat), stat)
+			return
+		}
+		settings, err := sys.LoadSettings(username)
+		if err != nil {
+			log.Printf("load settings for %s: %v", username, err)
+			settings = &sys.Settings{HideFollows: true}
+		}
+		items := make([]interface{}, len(actors))
+		for i := range actors {
+			items[len(actors)-1-i] = actors[i].ID
+		}
+		id := fmt.Sprintf("https://%s/%s/%s", domain, username, name)
+		serveCollection(w, req, id, items, settings.HideFollows)
+	}
+}
+
+// serveOutbox serves the Create and Announce activities
+// in username's outbox, most recent first.
+func serveOutbox(username string) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet && req.Method != http.MethodHead {
+			stat := http.StatusMethodNotAllowed
+			http.Error(w, http.StatusText(stat), stat)
+			return
+		}
+		activities, err := sys.Outbox(username, "Create", "Announce")
+		if err != nil {
+			log.Printf("read outbox of %s: %v", username, err)
+			stat := http.StatusInternalServerError
+			http.Error(w, http.StatusText(stat), stat)
+			return
+		}
+		items := make([]interface{}, len(activities))
+		for i := range activities {
+			items[i] = activities[i]
+		}
+		id := fmt.Sprintf("https://%s/%s/outbox", domain, username)
+		serveCollection(w, req, id, items, false)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+
+	"olowe.co/apub"
+	"olowe.co/apub/internal/sys"
+)
+
+// handleDelete trashes messages delivered to username
+// created from the object deleted by del.
+// If the deleted object is the actor itself,
+// the actor is removed from username's followers and following.
+func handleDelete(ctx context.Context, client *apub.Client, username string, del *apub.Activity) error {
+	id := del.ObjectID()
+	if id == "" {
+		return fmt.Errorf("no object")
+	}
+	// The object is usually gone by now, so we can't check who created it.
+	// Like other servers, only permit deletion of objects from the actor's own server.
+	if !sameOrigin(id, del.Actor) {
+		return fmt.Errorf("%s cannot delete %s from another server", del.Actor, id)
+	}
+	if id == del.Actor {
+		for _, open := range []func(string) (*sys.ActorSet, error){sys.OpenFollowers, sys.OpenFollowing} {
+			set, err := open(username)
+			if err != nil {
+				return err
+			}
+			if err := set.Remove(id); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	n, err := sys.TrashMessages(username, id)
+	if err != nil {
+		return fmt.Errorf("trash messages: %w", err)
+	}
+	if n > 0 {
+		log.Printf("trashed %d messages of %s for %s", n, id, username)
+	}
+	return nil
+}
+
+func sameOrigin(a, b string) bool {
+	ua, err := url.Parse(a)
+	if err != nil {
+		return false
+	}
+	ub, err := url.Parse(b)
+	if err != nil {
+		return false
+	}
+	return ua.Scheme == ub.Scheme && ua.Host == ub.Host
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+
+	"olowe.co/apub"
+	"olowe.co/apub/internal/sys"
+)
+
+// handleFollow accepts follow, a request to follow username,
+// or holds it for the user's approval if they have asked to
+// approve followers manually.
+func handleFollow(ctx context.Context, client *apub.Client, username string, follow *apub.Activity) error {
+	me, err := sys.Actor(username, domain)
+	if err != nil {
+		return fmt.Errorf("load actor: %w", err)
+	}
+	if id := follow.ObjectID(); id != me.ID {
+		return fmt.Errorf("follow %s is for %s, not %s", follow.ID, id, me.ID)
+	}
+	settings, err := sys.LoadSettings(username)
+	if err != nil {
+		log.Printf("load settings for %s: %v", username, err)
+		settings = &sys.Settings{}
+	}
+	if !settings.ManualFollow {
+		return sys.RespondFollow(ctx, client, username, domain, follow, true)
+	}
+
+	follower, err := client.LookupActorContext(ctx, follow.Actor)
+	if err != nil {
+		return fmt.Errorf("lookup follower %s: %w", follow.Actor, err)
+	}
+	pending, err := sys.OpenPending(username)
+	if err != nil {
+		return err
+	}
+	if err := pending.Add(follow); err != nil {
+		return fmt.Errorf("hold follow request: %w", err)
+	}
+	msg := sys.FollowRequestMail(username+"@"+domain, follower, follow)
+	return sys.DeliverLocal(username, msg)
+}
+
+// handleUndo removes the actor of undo from username's followers
+// if undo undoes a Follow.
+func handleUndo(ctx context.Context, client *apub.Client, username string, undo *apub.Activity) error {
+	inner, err := undo.UnwrapContext(ctx, client)
+	if err != nil {
+		return fmt.Errorf("unwrap undone activity: %w", err)
+	}
+	if inner.Type != "Follow" {
+		return nil
+	}
+	if inner.Actor != undo.Actor {
+		return fmt.Errorf("%s cannot undo follow by %s", undo.Actor, inner.Actor)
+	}
+	if pending, err := sys.OpenPending(username); err == nil {
+		pending.Remove(inner.ID)
+	}
+	followers, err := sys.OpenFollowers(username)
+	if err != nil {
+		return err
+	}
+	return followers.Remove(undo.Actor)
+}
+
+// handleResponse records the Accept or Reject of a follow request
+// sent by username. An accepted Actor is added to the user's following.
+func handleResponse(ctx context.Context, client *apub.Client, username string, response *apub.Activity) error {
+	requests, err := sys.OpenFollowRequests(username)
+	if err != nil {
+		return err
+	}
+	req, err := requests.Get(response.Actor)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("no follow request sent to %s", response.Actor)
+	} else if err != nil {
+		return fmt.Errorf("load follow request: %w", err)
+	}
+	if id := response.ObjectID(); id != "" && id != req.Follow.ID {
+		return fmt.Errorf("%s of unknown follow %s", response.Type, id)
+	}
+
+	following, err := sys.OpenFollowing(username)
+	if err != nil {
+		return err
+	}
+	if response.Type == "Reject" {
+		req.Status = sys.FollowRejected
+		if err := following.Remove(response.Actor); err != nil {
+			return fmt.Errorf("remove from following: %w", err)
+		}
+		return requests.Put(req)
+	}
+	followed, err := client.LookupActorContext(ctx, response.Actor)
+	if err != nil {
+		return fmt.Errorf("lookup %s: %w", response.Actor, err)
+	}
+	if err := following.Add(followed); err != nil {
+		return fmt.Errorf("add to following: %w", err)
+	}
+	req.Status = sys.FollowAccepted
+	return requests.Put(req)
+}
@@ -2,8 +2,11 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/fs"
 	"log"
 	"net/http"
@@ -12,6 +15,7 @@ import (
 	"os/user"
 	"path"
 	"strings"
+	"time"
 
 	"olowe.co/apub"
 	"olowe.co/apub/internal/sys"
@@ -20,58 +24,83 @@ import (
 type server struct {
 	acceptFor []user.User
 	relayAddr string
+	// sendmail delivers msg to the named user's mailbox.
+	// If nil, msg is piped to apsend.
+	sendmail func(ctx context.Context, username string, msg []byte) error
+	// openSeen opens the index of IDs received by the named user.
+	// If nil, sys.OpenSeen is used.
+	openSeen func(username string) (*sys.SeenIndex, error)
 }
 
-func (srv *server) relay(username string, activity *apub.Activity) {
+// timeout is the maximum duration spent handling a received activity,
+// including any requests to remote servers.
+const timeout = time.Minute
+
+func (srv *server) relay(ctx context.Context, username string, activity *apub.Activity) error {
 	var err error
 	switch activity.Type {
 	case "Note":
 		// check if we need to dereference
 		if activity.Content == "" {
-			activity, err = apub.Lookup(activity.ID)
+			id := activity.ID
+			activity, err = apub.DefaultClient.LookupContext(ctx, id)
 			if err != nil {
-				log.Printf("dereference %s %s: %v", activity.Type, activity.ID, err)
-				return
+				return fmt.Errorf("dereference Note %s: %w", id, err)
 			}
 		}
 	case "Page":
 		// check if we need to dereference
 		if activity.Name == "" {
-			activity, err = apub.Lookup(activity.ID)
+			id := activity.ID
+			activity, err = apub.DefaultClient.LookupContext(ctx, id)
 			if err != nil {
-				log.Printf("dereference %s %s: %v", activity.Type, activity.ID, err)
-				return
+				return fmt.Errorf("dereference Page %s: %w", id, err)
 			}
 		}
 	case "Create", "Update":
-		wrapped, err := activity.Unwrap(nil)
+		wrapped, err := activity.UnwrapContext(ctx, nil)
 		if err != nil {
-			log.Printf("unwrap from %s: %v", activity.ID, err)
-			return
+			return fmt.Errorf("unwrap from %s: %w", activity.ID, err)
 		}
-		srv.relay(username, wrapped)
-		return
+		if activity.Type == "Update" && wrapped.Updated == nil {
+			// needed to mark the message as superseding the original.
+			updated := time.Now()
+			if activity.Published != nil {
+				updated = *activity.Published
+			}
+			wrapped.Updated = &updated
+		}
+		return srv.relay(ctx, username, wrapped)
+	case "Like", "Dislike", "Announce":
+		// relayed as notifications
 	default:
-		return
+		return nil
 	}
 
-	cmd := exec.Command("apsend", username)
 	client, err := sys.ClientFor(username, domain)
 	if err != nil {
 		log.Printf("activitypub client for %s: %v", username, err)
 	}
-	msg, err := apub.MarshalMail(activity, client)
+	msg, err := apub.MarshalMailContext(ctx, activity, client, nil)
 	if err != nil {
-		log.Printf("marshal %s %s to mail message: %v", activity.Type, activity.ID, err)
-		return
+		return fmt.Errorf("marshal %s %s to mail message: %w", activity.Type, activity.ID, err)
+	}
+	sendmail := srv.sendmail
+	if sendmail == nil {
+		sendmail = apsend
 	}
+	if err := sendmail(ctx, username, msg); err != nil {
+		return fmt.Errorf("execute mailer for %s: %w", activity.ID, err)
+	}
+	return nil
+}
+
+// apsend delivers msg to the named user's mailbox using apsend.
+func apsend(ctx context.Context, username string, msg []byte) error {
+	cmd := exec.CommandContext(ctx, "apsend", username)
 	cmd.Stdin = bytes.NewReader(msg)
 	cmd.Stderr = os.Stderr
-	err = cmd.Run()
-	if err != nil {
-		log.Printf("execute mailer for %s: %v", activity.ID, err)
-		return
-	}
+	return cmd.Run()
 }
 
 func (srv *server) handleInbox(w http.ResponseWriter, req *http.Request) {
@@ -109,16 +138,50 @@ func (srv *server) handleInbox(w http.ResponseWriter, req *http.Request) {
 	}
 
 	defer req.Body.Close()
+	client, err := sys.ClientFor(username, domain)
+	if err != nil {
+		log.Printf("activitypub client for %s: %v", username, err)
+		client = &apub.DefaultClient
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), timeout)
+	defer cancel()
+	var owner string
+	keyID, err := apub.Verify(req, func(id string) (crypto.PublicKey, error) {
+		key, id, err := lookupKey(ctx, client, id)
+		owner = id
+		return key, err
+	})
+	if err != nil {
+		log.Printf("handle inbox: verify request from %s: %v", req.RemoteAddr, err)
+		http.Error(w, "bad or missing http signature", http.StatusUnauthorized)
+		return
+	}
+
 	var rcv apub.Activity // received
 	if err := json.NewDecoder(req.Body).Decode(&rcv); err != nil {
 		log.Println("decode apub message:", err)
 		http.Error(w, "malformed activitypub message", http.StatusBadRequest)
 		return
 	}
+	if rcv.Actor != owner {
+		log.Printf("handle inbox: %s %s from %s signed by %s", rcv.Type, rcv.ID, rcv.Actor, keyID)
+		http.Error(w, "activity actor does not own signing key", http.StatusForbidden)
+		return
+	}
+	if err := authorise(ctx, client, &rcv); err != nil {
+		log.Printf("handle inbox: %s %s from %s: %v", rcv.Type, rcv.ID, rcv.Actor, err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	settings, err := sys.LoadSettings(username)
+	if err != nil {
+		log.Printf("load settings for %s: %v", username, err)
+		settings = &sys.Settings{}
+	}
 	activity := &rcv
 	if rcv.Type == "Announce" {
 		var err error
-		activity, err = rcv.Unwrap(nil)
+		activity, err = announced(ctx, client, username, &rcv, settings.Notify)
 		if err != nil {
 			err = fmt.Errorf("unwrap apub object in %s: %w", rcv.ID, err)
 			log.Println(err)
@@ -133,22 +196,265 @@ func (srv *server) handleInbox(w http.ResponseWriter, req *http.Request) {
 	if activity.Type != "Like" && activity.Type != "Dislike" {
 		log.Printf("%s %s received from %s", activity.Type, activity.ID, raddr)
 	}
+	if srv.duplicate(username, &rcv, activity) {
+		log.Printf("%s %s for %s already received", activity.Type, activity.ID, username)
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
 	switch activity.Type {
-	case "Accept", "Reject":
+	case "Follow", "Undo", "Delete", "Accept", "Reject":
 		w.WriteHeader(http.StatusAccepted)
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			handle := handlers[activity.Type]
+			if err := handle(ctx, client, username, activity); err != nil {
+				log.Printf("handle %s %s for %s: %v", activity.Type, activity.ID, username, err)
+				srv.forget(username, &rcv, activity)
+			}
+		}()
 		return
-	case "Create", "Note", "Page", "Article":
+	case "Like", "Dislike", "Announce":
+		w.WriteHeader(http.StatusAccepted)
+		if !settings.Notify {
+			return
+		}
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			if err := srv.relay(ctx, username, activity); err != nil {
+				log.Printf("relay %s %s to %s: %v", activity.Type, activity.ID, username, err)
+				srv.forget(username, &rcv, activity)
+			}
+		}()
+		return
+	case "Create", "Update", "Note", "Page", "Article":
 		w.WriteHeader(http.StatusAccepted)
 		log.Printf("accepted %s %s for %s", activity.Type, activity.ID, username)
-		go srv.relay(username, activity)
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			if err := srv.relay(ctx, username, activity); err != nil {
+				log.Printf("relay %s %s to %s: %v", activity.Type, activity.ID, username, err)
+				srv.forget(username, &rcv, activity)
+			}
+		}()
 		return
 	}
 	w.WriteHeader(http.StatusAccepted)
 }
 
-func serveActivityFile(hfsys http.Handler) http.HandlerFunc {
+// duplicate reports whether username has already received rcv,
+// or the post it carries, recording them as received if not.
+// activity is rcv, or the post unwrapped from rcv if rcv is an Announce.
+// The object of an Update is the post it edits, so only its own ID is checked;
+// likewise for reactions, whose objects are the user's own posts.
+func (srv *server) duplicate(username string, rcv, activity *apub.Activity) bool {
+	seen, err := srv.seenIndex(username)
+	if err != nil {
+		log.Printf("open seen index of %s: %v", username, err)
+		return false
+	}
+	dup, err := seen.Add(receivedIDs(rcv, activity)...)
+	if err != nil {
+		log.Printf("record %s as seen by %s: %v", rcv.ID, username, err)
+	}
+	return dup
+}
+
+// forget removes the record of rcv and the post it carries
+// made by duplicate, so that a retry of rcv after a failure
+// to handle it is not dropped as already received.
+func (srv *server) forget(username string, rcv, activity *apub.Activity) {
+	seen, err := srv.seenIndex(username)
+	if err != nil {
+		log.Printf("open seen index of %s: %v", username, err)
+		return
+	}
+	if err := seen.Remove(receivedIDs(rcv, activity)...); err != nil {
+		log.Printf("forget %s seen by %s: %v", rcv.ID, username, err)
+	}
+}
+
+func (srv *server) seenIndex(username string) (*sys.SeenIndex, error) {
+	if srv.openSeen != nil {
+		return srv.openSeen(username)
+	}
+	return sys.OpenSeen(username)
+}
+
+// receivedIDs returns the IDs checked by duplicate.
+func receivedIDs(rcv, activity *apub.Activity) []string {
+	ids := []string{rcv.ID}
+	switch activity.Type {
+	case "Create":
+		ids = append(ids, activity.ObjectID())
+	case "Note", "Page", "Article":
+		ids = append(ids, activity.ID)
+	}
+	return ids
+}
+
+// handlers handle activities which are not relayed as mail.
+var handlers = map[string]func(ctx context.Context, client *apub.Client, username string, activity *apub.Activity) error{
+	"Follow": handleFollow,
+	"Undo":   handleUndo,
+	"Delete": handleDelete,
+	"Accept": handleResponse,
+	"Reject": handleResponse,
+}
+
+// lookupKey returns the public key identified by keyID
+// and the ID of the Actor which owns it.
+// The Actor must be served from the same origin as the key;
+// see apub.Actor.Key.
+func lookupKey(ctx context.Context, client *apub.Client, keyID string) (key crypto.PublicKey, owner string, err error) {
+	actor, err := client.LookupActorContext(ctx, keyID)
+	if err != nil {
+		return nil, "", fmt.Errorf("lookup actor: %w", err)
+	}
+	key, err = actor.Key(keyID)
+	if err != nil {
+		return nil, "", err
+	}
+	return key, actor.ID, nil
+}
+
+// authorise checks that the actor of rcv may send the objects it carries.
+// Posts must be attributed to the actor; we would otherwise
+// deliver mail from anyone on behalf of any signed request.
+// The object of a Create or Update is replaced by one which can be trusted;
+// see trustedObject.
+func authorise(ctx context.Context, client *apub.Client, rcv *apub.Activity) error {
+	switch rcv.Type {
+	case "Note", "Page", "Article":
+		if rcv.AttributedTo != rcv.Actor {
+			return fmt.Errorf("%s attributed to %s", rcv.ID, rcv.AttributedTo)
+		}
+	case "Create", "Update":
+		obj, err := trustedObject(ctx, client, rcv)
+		if err != nil {
+			return fmt.Errorf("object: %w", err)
+		}
+		// Actors may update themselves, too.
+		if obj.AttributedTo != rcv.Actor && obj.ID != rcv.Actor {
+			return fmt.Errorf("object %s attributed to %s", obj.ID, obj.AttributedTo)
+		}
+		b, err := json.Marshal(obj)
+		if err != nil {
+			return fmt.Errorf("encode object: %w", err)
+		}
+		rcv.Object = b
+	}
+	return nil
+}
+
+// trustedObject returns the object of activity.
+// An object embedded in activity is only trusted if it comes from
+// the same origin as the activity's actor, who signed it;
+// others are looked up by their ID.
+func trustedObject(ctx context.Context, client *apub.Client, activity *apub.Activity) (*apub.Activity, error) {
+	obj, err := activity.UnwrapContext(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+	var id string
+	embedded := json.Unmarshal(activity.Object, &id) != nil
+	if embedded && sameOrigin(obj.ID, activity.Actor) {
+		return obj, nil
+	}
+	if embedded {
+		id = obj.ID
+		if obj, err = client.LookupContext(ctx, id); err != nil {
+			return nil, fmt.Errorf("lookup %s: %w", id, err)
+		}
+	}
+	if !sameOrigin(obj.ID, id) {
+		return nil, fmt.Errorf("%s served object %s", id, obj.ID)
+	}
+	return obj, nil
+}
+
+// announced returns the activity to handle for the Announce rcv.
+// If notify is true, announcements of username's own posts are
+// handled as notifications. Other announced posts are unwrapped
+// to be relayed like any other post.
+func announced(ctx context.Context, client *apub.Client, username string, rcv *apub.Activity, notify bool) (*apub.Activity, error) {
+	if notify && ownObject(username, rcv.ObjectID()) {
+		return rcv, nil
+	}
+	return trustedObject(ctx, client, rcv)
+}
+
+// ownObject reports whether id is that of an object published by username.
+func ownObject(username, id string) bool {
+	return strings.HasPrefix(id, fmt.Sprintf("https://%s/%s/", domain, username))
+}
+
+// privateDirs are files and directories in a user's data directory
+// which must never be served.
+var privateDirs = []string{"queue", "followers", "following", "pending", "follows", "seen", "messages"}
+
+// serveActivityFile serves the activities and objects stored in dir.
+// Deleted objects, replaced by Tombstones, are served with
+// the status 410 Gone so that other servers drop their copies.
+func serveActivityFile(dir http.FileSystem) http.HandlerFunc {
+	hfsys := http.FileServer(dir)
 	return func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "" || strings.HasSuffix(req.URL.Path, "/") {
+			// no directory listings; collections are served elsewhere.
+			http.NotFound(w, req)
+			return
+		}
+		if strings.HasPrefix(path.Base(req.URL.Path), ".") {
+			// lock and temporary files.
+			http.NotFound(w, req)
+			return
+		}
+		first, _, _ := strings.Cut(strings.TrimPrefix(req.URL.Path, "/"), "/")
+		for _, dir := range privateDirs {
+			if first == dir {
+				http.NotFound(w, req)
+				return
+			}
+		}
 		w.Header().Set("Content-Type", apub.ContentType)
+		if b, err := readFile(dir, req.URL.Path); err == nil {
+			var obj struct {
+				Type string `json:"type"`
+			}
+			if json.Unmarshal(b, &obj) == nil && obj.Type == "Tombstone" {
+				w.WriteHeader(http.StatusGone)
+				w.Write(b)
+				return
+			}
+		}
+		hfsys.ServeHTTP(w, req)
+	}
+}
+
+func readFile(dir http.FileSystem, name string) ([]byte, error) {
+	f, err := dir.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// serveMedia serves files attached to posts,
+// with the media type they were stored as.
+func serveMedia(dir http.FileSystem) http.HandlerFunc {
+	hfsys := http.FileServer(dir)
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "" || strings.Contains(req.URL.Path, "/") || strings.HasPrefix(req.URL.Path, ".") {
+			http.NotFound(w, req)
+			return
+		}
+		if typ := sys.MediaType(req.URL.Path); typ != "" {
+			w.Header().Set("Content-Type", typ)
+		}
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
 		hfsys.ServeHTTP(w, req)
 	}
 }
@@ -177,14 +483,27 @@ func main() {
 	http.HandleFunc("/nodeinfo/2.0.json", srv.serveNodeInfo)
 
 	for _, u := range acceptFor {
+		username := u.Username
 		dataDir := path.Join(u.HomeDir, "apubtest")
 		root := fmt.Sprintf("/%s/", u.Username)
-		hfsys := serveActivityFile(http.FileServer(http.Dir(dataDir)))
+		hfsys := serveActivityFile(http.Dir(dataDir))
 		http.Handle(root, http.StripPrefix(root, hfsys))
 		inbox := path.Join(root, "inbox")
 		http.HandleFunc(inbox, srv.handleInbox)
+		// serve the actor generated from the user's keys,
+		// so that it always lists our collections.
+		http.HandleFunc(path.Join(root, "actor.json"), func(w http.ResponseWriter, req *http.Request) {
+			serveActor(w, *req, username)
+		})
+		http.HandleFunc(path.Join(root, "followers"), serveFollows(username, "followers", sys.OpenFollowers))
+		http.HandleFunc(path.Join(root, "following"), serveFollows(username, "following", sys.OpenFollowing))
+		http.HandleFunc(path.Join(root, "outbox"), serveOutbox(username))
+		media := path.Join(root, "media") + "/"
+		http.Handle(media, http.StripPrefix(media, serveMedia(http.Dir(path.Join(dataDir, "media")))))
 	}
 
+	go srv.runQueues()
+
 	sub, err := fs.Sub(apub.DocFS, "doc")
 	if err != nil {
 		log.Fatalln("load documentation:", err)
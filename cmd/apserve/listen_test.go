@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"os"
+	"os/user"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"olowe.co/apub"
+	"olowe.co/apub/internal/sys"
+)
+
+// serveDocs serves each document in docs at its path.
+// Occurrences of "SRV" in documents are replaced by the server's URL.
+func serveDocs(docs map[string]string) *httptest.Server {
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		doc, ok := docs[req.URL.Path]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		w.Header().Set("Content-Type", apub.ContentType)
+		fmt.Fprint(w, strings.ReplaceAll(doc, "SRV", srv.URL))
+	}))
+	return srv
+}
+
+func TestLookupKey(t *testing.T) {
+	pem, err := os.ReadFile("../../testdata/public.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	actor := func(id, keyID, owner string) string {
+		key := map[string]string{"id": keyID, "owner": owner, "publicKeyPem": string(pem)}
+		b, err := json.Marshal(map[string]interface{}{"type": "Person", "id": id, "publicKey": key})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+	srv := serveDocs(map[string]string{
+		"/good": actor("SRV/good", "SRV/good#main-key", "SRV/good"),
+		// served by us, claiming to be someone else.
+		"/forged": actor("https://mastodon.social/users/x", "https://mastodon.social/users/x#main-key", "https://mastodon.social/users/x"),
+		"/owner":  actor("SRV/owner", "SRV/owner#main-key", "SRV/good"),
+	})
+	defer srv.Close()
+	client := &apub.Client{Client: srv.Client()}
+
+	tests := []struct {
+		name  string
+		keyID string
+		ok    bool
+	}{
+		{"good", srv.URL + "/good#main-key", true},
+		{"mismatched origin", srv.URL + "/forged#main-key", false},
+		{"wrong owner", srv.URL + "/owner#main-key", false},
+	}
+	for _, tt := range tests {
+		_, owner, err := lookupKey(context.Background(), client, tt.keyID)
+		if tt.ok && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else if !tt.ok && err == nil {
+			t.Errorf("%s: accepted key %s of %s", tt.name, tt.keyID, owner)
+		}
+		if tt.ok && owner != srv.URL+"/good" {
+			t.Errorf("%s: want owner %s, got %s", tt.name, srv.URL+"/good", owner)
+		}
+	}
+}
+
+func TestAuthorise(t *testing.T) {
+	// other is on a different origin to srv, serving posts of its own actor.
+	other := serveDocs(map[string]string{
+		"/note/1": `{"type": "Note", "id": "SRV/note/1", "attributedTo": "SRV/actor", "content": "the real post"}`,
+	})
+	defer other.Close()
+	srv := serveDocs(nil)
+	defer srv.Close()
+	client := &apub.Client{Client: srv.Client()}
+	actor := srv.URL + "/actor"
+
+	create := func(object string) *apub.Activity {
+		return &apub.Activity{Type: "Create", ID: srv.URL + "/create", Actor: actor, Object: json.RawMessage(object)}
+	}
+	tests := []struct {
+		name     string
+		activity *apub.Activity
+		ok       bool
+	}{
+		{
+			"own post",
+			create(fmt.Sprintf(`{"type": "Note", "id": "%s/note/1", "attributedTo": "%s"}`, srv.URL, actor)),
+			true,
+		},
+		{
+			"forged attributedTo",
+			create(fmt.Sprintf(`{"type": "Note", "id": "%s/note/1", "attributedTo": "%s/actor"}`, srv.URL, other.URL)),
+			false,
+		},
+		{
+			// the embedded copy claims to be ours, but the original is not.
+			"foreign post",
+			create(fmt.Sprintf(`{"type": "Note", "id": "%s/note/1", "attributedTo": "%s", "content": "forged"}`, other.URL, actor)),
+			false,
+		},
+		{
+			"bare note",
+			&apub.Activity{Type: "Note", ID: other.URL + "/note/2", Actor: actor, AttributedTo: other.URL + "/actor"},
+			false,
+		},
+		{
+			"self update",
+			&apub.Activity{Type: "Update", ID: srv.URL + "/update", Actor: actor, Object: json.RawMessage(fmt.Sprintf(`{"type": "Person", "id": "%s"}`, actor))},
+			true,
+		},
+	}
+	for _, tt := range tests {
+		err := authorise(context.Background(), client, tt.activity)
+		if tt.ok && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else if !tt.ok && err == nil {
+			t.Errorf("%s: authorised %s", tt.name, tt.activity.Object)
+		}
+	}
+}
+
+func TestTrustedObject(t *testing.T) {
+	other := serveDocs(map[string]string{
+		"/note/1": `{"type": "Note", "id": "SRV/note/1", "attributedTo": "SRV/actor", "content": "the real post"}`,
+	})
+	defer other.Close()
+	announce := &apub.Activity{
+		Type:   "Announce",
+		Actor:  "https://booster.example/actor",
+		Object: json.RawMessage(fmt.Sprintf(`{"type": "Note", "id": "%s/note/1", "attributedTo": "%s/actor", "content": "forged"}`, other.URL, other.URL)),
+	}
+	obj, err := trustedObject(context.Background(), &apub.Client{Client: other.Client()}, announce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if obj.Content != "the real post" {
+		t.Errorf("embedded object from another origin was trusted: got content %q", obj.Content)
+	}
+}
+
+func TestAnnounced(t *testing.T) {
+	other := serveDocs(map[string]string{
+		"/note/1": `{"type": "Note", "id": "SRV/note/1", "attributedTo": "SRV/actor", "content": "boosted"}`,
+	})
+	defer other.Close()
+	client := &apub.Client{Client: other.Client()}
+	announce := func(object string) *apub.Activity {
+		b, err := json.Marshal(object)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &apub.Activity{Type: "Announce", Actor: other.URL + "/actor", Object: b}
+	}
+
+	own := announce(fmt.Sprintf("https://%s/alice/1", domain))
+	got, err := announced(context.Background(), client, "alice", own, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != own {
+		t.Errorf("announcement of own post not handled as notification: got %s %s", got.Type, got.ID)
+	}
+
+	for _, notify := range []bool{true, false} {
+		got, err := announced(context.Background(), client, "alice", announce(other.URL+"/note/1"), notify)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Type != "Note" || got.Content != "boosted" {
+			t.Errorf("notify %v: announced post not unwrapped: got %s %s", notify, got.Type, got.ID)
+		}
+	}
+}
+
+func TestServeTombstone(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(path.Join(dir, "outbox"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"outbox/1": `{"type": "Note", "id": "https://example.com/alice/outbox/1"}`,
+		"outbox/2": `{"type": "Tombstone", "id": "https://example.com/alice/outbox/2", "formerType": "Note"}`,
+	}
+	for name, content := range files {
+		if err := os.WriteFile(path.Join(dir, name), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	serve := serveActivityFile(http.Dir(dir))
+	tests := map[string]int{
+		"/outbox/1":        http.StatusOK,
+		"/outbox/2":        http.StatusGone,
+		"/outbox/3":        http.StatusNotFound,
+		"/followers":       http.StatusNotFound,
+		"/.followers.lock": http.StatusNotFound,
+	}
+	for name, want := range tests {
+		rec := httptest.NewRecorder()
+		serve(rec, httptest.NewRequest(http.MethodGet, name, nil))
+		if rec.Code != want {
+			t.Errorf("%s: got status %d, want %d", name, rec.Code, want)
+		}
+	}
+}
+
+// serveInbox serves the inbox of the current user from srv,
+// returning a server of a remote actor at /actor and
+// a function to send activities from it to the inbox.
+func serveInbox(t *testing.T, srv *server) (remote *httptest.Server, send func(*apub.Activity) error) {
+	t.Helper()
+	pem, err := os.ReadFile("../../testdata/public.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile("../../testdata/private.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := apub.ParsePrivateKey(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, err := user.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	actor, err := json.Marshal(map[string]interface{}{
+		"type":              "Person",
+		"id":                "SRV/actor",
+		"preferredUsername": "bob",
+		"inbox":             "SRV/inbox",
+		"publicKey":         map[string]string{"id": "SRV/actor#main-key", "owner": "SRV/actor", "publicKeyPem": string(pem)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote = serveDocs(map[string]string{"/actor": string(actor)})
+	t.Cleanup(remote.Close)
+
+	seen := path.Join(t.TempDir(), "seen")
+	srv.acceptFor = []user.User{*current}
+	srv.openSeen = func(string) (*sys.SeenIndex, error) { return sys.OpenSeenFile(seen), nil }
+	local := httptest.NewServer(http.HandlerFunc(srv.handleInbox))
+	t.Cleanup(local.Close)
+
+	client := &apub.Client{Client: http.DefaultClient, Key: key, PubKeyID: remote.URL + "/actor#main-key"}
+	send = func(activity *apub.Activity) error {
+		_, err := client.Send(local.URL+"/"+current.Username+"/inbox", activity)
+		return err
+	}
+	return remote, send
+}
+
+// remoteNote returns a Note by the actor served by remote.
+func remoteNote(t *testing.T, remote *httptest.Server, content string, published, updated *time.Time) json.RawMessage {
+	b, err := json.Marshal(&apub.Activity{
+		AtContext:    apub.NormContext,
+		Type:         "Note",
+		ID:           remote.URL + "/note/1",
+		AttributedTo: remote.URL + "/actor",
+		Content:      content,
+		Published:    published,
+		Updated:      updated,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestInboxUpdate(t *testing.T) {
+	mailed := make(chan []byte, 1)
+	srv := &server{
+		sendmail: func(_ context.Context, _ string, msg []byte) error {
+			mailed <- msg
+			return nil
+		},
+	}
+	remote, send := serveInbox(t, srv)
+
+	published := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	updated := published.Add(time.Hour)
+	update := &apub.Activity{
+		AtContext: apub.NormContext,
+		Type:      "Update",
+		ID:        remote.URL + "/note/1/update",
+		Actor:     remote.URL + "/actor",
+		Published: &updated,
+		Object:    remoteNote(t, remote, "edited", &published, &updated),
+	}
+	if err := send(update); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case b := <-mailed:
+		msg, err := mail.ReadMessage(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := "<" + remote.URL + "/note/1>"
+		if got := msg.Header.Get("Supersedes"); got != want {
+			t.Errorf("relayed update has Supersedes %q, want %q", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("update not relayed")
+	}
+}
+
+func TestInboxRetry(t *testing.T) {
+	attempts := make(chan bool)
+	var failed bool
+	srv := &server{
+		// the first delivery fails, as if the Maildir could not be written.
+		sendmail: func(context.Context, string, []byte) error {
+			if !failed {
+				failed = true
+				attempts <- false
+				return errors.New("mailbox unavailable")
+			}
+			attempts <- true
+			return nil
+		},
+	}
+	remote, send := serveInbox(t, srv)
+
+	published := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	create := &apub.Activity{
+		AtContext: apub.NormContext,
+		Type:      "Create",
+		ID:        remote.URL + "/note/1/create",
+		Actor:     remote.URL + "/actor",
+		Published: &published,
+		Object:    remoteNote(t, remote, "hello", &published, nil),
+	}
+	if err := send(create); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-attempts:
+	case <-time.After(5 * time.Second):
+		t.Fatal("create not relayed")
+	}
+	// like a remote server, retry until delivered.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if err := send(create); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case ok := <-attempts:
+			if !ok {
+				t.Fatal("unexpected failed delivery")
+			}
+			return
+		case <-time.After(100 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("retry after failed relay dropped as already received")
+		}
+	}
+}
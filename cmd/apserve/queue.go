@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"olowe.co/apub/internal/sys"
+)
+
+// queueInterval is the time between runs of the delivery queues.
+const queueInterval = time.Minute
+
+// runQueues retries delivery of activities queued by apsend
+// for each user we serve, forever.
+func (srv *server) runQueues() {
+	for {
+		for _, u := range srv.acceptFor {
+			if err := runQueue(u.Username); err != nil {
+				log.Printf("run delivery queue for %s: %v", u.Username, err)
+			}
+		}
+		time.Sleep(queueInterval)
+	}
+}
+
+func runQueue(username string) error {
+	queue, err := sys.OpenQueue(username)
+	if err != nil {
+		return err
+	}
+	client, err := sys.ClientFor(username, domain)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), queueInterval)
+	defer cancel()
+	return queue.Run(ctx, client, func(item *sys.QueueItem, err error) {
+		log.Printf("deliver to %s: %v", item.Inbox, err)
+		if !errors.Is(err, sys.ErrUndeliverable) {
+			return // retried later
+		}
+		failure := sys.Failure{Recipient: item.Inbox, Err: err}
+		msg, err := queue.Message(item)
+		if err != nil {
+			log.Printf("read queued message for %s: %v", item.Inbox, err)
+		}
+		dsn, err := sys.Bounce(domain, username+"@"+domain, msg, []sys.Failure{failure})
+		if err != nil {
+			log.Printf("create bounce message: %v", err)
+			return
+		}
+		if err := sys.DeliverLocal(username, dsn); err != nil {
+			log.Printf("deliver bounce message to %s: %v", username, err)
+		}
+	})
+}
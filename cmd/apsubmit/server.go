@@ -71,7 +71,7 @@ func (s *Session) Rcpt(to string, opts *smtp.RcptOptions) error {
 }
 
 func (s *Session) Data(r io.Reader) error {
-	args := append([]string{"-F"}, s.recipients...)
+	args := append([]string{"-F", "-r"}, s.recipients...)
 	cmd := exec.Command("apsend", args...)
 	cmd.Stdin = r
 	cmd.Stderr = os.Stderr
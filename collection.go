@@ -0,0 +1,254 @@
+package apub
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Collection represents the Activity Streams Collection and OrderedCollection types,
+// and their pages CollectionPage and OrderedCollectionPage.
+// Collections may hold their items directly,
+// but most are split into pages linked by First and Next.
+// See Activity Streams 2.0, section 5.3.
+type Collection struct {
+	AtContext  string `json:"@context,omitempty"`
+	ID         string `json:"id"`
+	Type       string `json:"type"`
+	TotalItems int    `json:"totalItems"`
+	// First and Last are the IDs of the first and last pages.
+	First string `json:"first,omitempty"`
+	Last  string `json:"last,omitempty"`
+	// Next, Prev and PartOf link a page to its neighbours
+	// and to the collection it belongs to.
+	Next   string `json:"next,omitempty"`
+	Prev   string `json:"prev,omitempty"`
+	PartOf string `json:"partOf,omitempty"`
+	// Items and OrderedItems hold either JSON-encoded Activities
+	// or IDs of Activities as JSON strings.
+	// Use Walker to access the decoded items.
+	Items        []json.RawMessage `json:"items,omitempty"`
+	OrderedItems []json.RawMessage `json:"orderedItems,omitempty"`
+
+	// first is the first page when embedded in the collection,
+	// as Mastodon does for replies.
+	first *Collection
+}
+
+func (c *Collection) UnmarshalJSON(b []byte) error {
+	type Alias Collection
+	aux := &struct {
+		AtContext interface{}     `json:"@context"`
+		First     json.RawMessage `json:"first"`
+		Last      json.RawMessage `json:"last"`
+		Next      json.RawMessage `json:"next"`
+		Prev      json.RawMessage `json:"prev"`
+		*Alias
+	}{
+		Alias: (*Alias)(c),
+	}
+	if err := json.Unmarshal(b, &aux); err != nil {
+		return err
+	}
+	switch v := aux.AtContext.(type) {
+	case string:
+		c.AtContext = v
+	case []interface{}:
+		if vv, ok := v[0].(string); ok {
+			c.AtContext = vv
+		}
+	}
+	var err error
+	if c.First, c.first, err = link(aux.First); err != nil {
+		return fmt.Errorf("first: %w", err)
+	}
+	if c.Last, _, err = link(aux.Last); err != nil {
+		return fmt.Errorf("last: %w", err)
+	}
+	if c.Next, _, err = link(aux.Next); err != nil {
+		return fmt.Errorf("next: %w", err)
+	}
+	if c.Prev, _, err = link(aux.Prev); err != nil {
+		return fmt.Errorf("prev: %w", err)
+	}
+	return nil
+}
+
+// link decodes a property referencing a page,
+// either by ID or by embedding the page.
+func link(b json.RawMessage) (id string, page *Collection, err error) {
+	if len(b) == 0 || string(b) == "null" {
+		return "", nil, nil
+	}
+	if err := json.Unmarshal(b, &id); err == nil {
+		return id, nil, nil
+	}
+	page = &Collection{}
+	if err := json.Unmarshal(b, page); err != nil {
+		return "", nil, err
+	}
+	return page.ID, page, nil
+}
+
+// LookupCollection looks up the Collection, or collection page, with the given id.
+func (c *Client) LookupCollection(id string) (*Collection, error) {
+	return c.LookupCollectionContext(context.Background(), id)
+}
+
+// LookupCollectionContext is like LookupCollection but uses ctx for the underlying HTTP request.
+func (c *Client) LookupCollectionContext(ctx context.Context, id string) (*Collection, error) {
+	body, err := c.get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	var col Collection
+	if err := json.NewDecoder(body).Decode(&col); err != nil {
+		return nil, fmt.Errorf("decode collection: %w", err)
+	}
+	if !strings.HasSuffix(col.Type, "Collection") && !strings.HasSuffix(col.Type, "CollectionPage") {
+		return nil, fmt.Errorf("bad object Type %s", col.Type)
+	}
+	return &col, nil
+}
+
+// get returns the body of the response to a GET request of id.
+func (c *Client) get(ctx context.Context, id string) (io.ReadCloser, error) {
+	if !strings.HasPrefix(id, "http") {
+		return nil, fmt.Errorf("id is not a HTTP URL")
+	}
+	resp, err := c.do(ctx, http.MethodGet, id, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, ErrNotExist
+	} else if resp.StatusCode == http.StatusGone {
+		resp.Body.Close()
+		return nil, ErrGone
+	} else if resp.StatusCode >= 400 {
+		resp.Body.Close()
+		return nil, newStatusError(resp)
+	}
+	return resp.Body, nil
+}
+
+// Walker iterates over the items of a Collection,
+// fetching pages of the collection as needed.
+// Items referenced only by ID are looked up.
+//
+//	w := client.Walk(actor.Outbox, 20)
+//	for w.Next() {
+//		fmt.Println(w.Activity().ID)
+//	}
+//	if w.Err() != nil {
+//		// handle error
+//	}
+type Walker struct {
+	ctx    context.Context
+	client *Client
+	limit  int
+	n      int
+	next   string
+	// embedded is the next page, if embedded in the previous.
+	embedded *Collection
+	items    []json.RawMessage
+	seen     map[string]bool
+	cur      *Activity
+	err      error
+}
+
+// Walk returns a Walker over the items of the collection id.
+// At most limit items are walked; if limit is zero or less,
+// all items are walked.
+func (c *Client) Walk(id string, limit int) *Walker {
+	return c.WalkContext(context.Background(), id, limit)
+}
+
+// WalkContext is like Walk but uses ctx for all requests.
+func (c *Client) WalkContext(ctx context.Context, id string, limit int) *Walker {
+	return &Walker{
+		ctx:    ctx,
+		client: c,
+		limit:  limit,
+		next:   id,
+		seen:   make(map[string]bool),
+	}
+}
+
+// Next advances the Walker to the next item, which is then
+// available from Activity. It returns false when there are no
+// more items, the limit has been reached, or an error occurred.
+func (w *Walker) Next() bool {
+	if w.err != nil || (w.limit > 0 && w.n >= w.limit) {
+		return false
+	}
+	for len(w.items) == 0 {
+		if !w.nextPage() {
+			return false
+		}
+	}
+	raw := w.items[0]
+	w.items = w.items[1:]
+
+	var id string
+	if err := json.Unmarshal(raw, &id); err == nil {
+		w.cur, w.err = w.client.LookupContext(w.ctx, id)
+	} else {
+		var a Activity
+		if w.err = json.Unmarshal(raw, &a); w.err == nil {
+			w.cur = &a
+		}
+	}
+	if w.err != nil {
+		w.err = fmt.Errorf("item %d: %w", w.n, w.err)
+		return false
+	}
+	w.n++
+	return true
+}
+
+// nextPage loads the next page of items.
+func (w *Walker) nextPage() bool {
+	page := w.embedded
+	w.embedded = nil
+	if page == nil {
+		if w.next == "" || w.seen[w.next] {
+			// no more pages, or a page linking to one we've seen.
+			return false
+		}
+		var err error
+		page, err = w.client.LookupCollectionContext(w.ctx, w.next)
+		if err != nil {
+			w.err = fmt.Errorf("lookup %s: %w", w.next, err)
+			return false
+		}
+		w.seen[w.next] = true
+	}
+	w.seen[page.ID] = true
+	w.items = append(page.OrderedItems, page.Items...)
+	// A collection links to its first page; a page links to the next.
+	switch {
+	case page.first != nil:
+		w.embedded, w.next = page.first, ""
+	case page.First != "" && !w.seen[page.First]:
+		w.next = page.First
+	default:
+		w.next = page.Next
+	}
+	return true
+}
+
+// Activity returns the current item.
+func (w *Walker) Activity() *Activity {
+	return w.cur
+}
+
+// Err returns the first error encountered while walking, if any.
+func (w *Walker) Err() error {
+	return w.err
+}
@@ -0,0 +1,88 @@
+package apub
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestDecodeCollection(t *testing.T) {
+	for _, name := range []string{"testdata/following", "testdata/following1"} {
+		b, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var c Collection
+		if err := json.Unmarshal(b, &c); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if c.TotalItems != 67 {
+			t.Errorf("%s: want 67 total items, got %d", name, c.TotalItems)
+		}
+		if c.Type == "OrderedCollection" && c.First != "https://hachyderm.io/users/otl/following?page=1" {
+			t.Errorf("%s: unexpected first page %q", name, c.First)
+		}
+		if c.Type == "OrderedCollectionPage" && (c.Next == "" || len(c.OrderedItems) == 0) {
+			t.Errorf("%s: page has no next page or no items", name)
+		}
+	}
+}
+
+func TestWalk(t *testing.T) {
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", ContentType)
+		switch req.URL.RequestURI() {
+		case "/replies":
+			// first page embedded, like Mastodon.
+			fmt.Fprintf(w, `{"id": "%[1]s/replies", "type": "Collection", "first": {
+				"id": "%[1]s/replies?page=1", "type": "CollectionPage",
+				"next": "%[1]s/replies?page=2",
+				"items": [{"id": "%[1]s/notes/1", "type": "Note"}, "%[1]s/notes/2"]
+			}}`, srv.URL)
+		case "/replies?page=2":
+			fmt.Fprintf(w, `{"id": "%[1]s/replies?page=2", "type": "CollectionPage",
+				"prev": "%[1]s/replies?page=1",
+				"items": ["%[1]s/notes/3", "%[1]s/notes/4"]}`, srv.URL)
+		case "/notes/2", "/notes/3", "/notes/4":
+			fmt.Fprintf(w, `{"id": "%s%s", "type": "Note"}`, srv.URL, req.URL.Path)
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	defer srv.Close()
+	client := &Client{Client: srv.Client()}
+
+	var ids []string
+	walker := client.Walk(srv.URL+"/replies", 0)
+	for walker.Next() {
+		ids = append(ids, walker.Activity().ID)
+	}
+	if walker.Err() != nil {
+		t.Fatal(walker.Err())
+	}
+	if len(ids) != 4 {
+		t.Fatalf("want 4 items, got %d: %v", len(ids), ids)
+	}
+	for i := range ids {
+		want := fmt.Sprintf("%s/notes/%d", srv.URL, i+1)
+		if ids[i] != want {
+			t.Errorf("item %d: got %s, want %s", i, ids[i], want)
+		}
+	}
+
+	walker = client.Walk(srv.URL+"/replies", 3)
+	var n int
+	for walker.Next() {
+		n++
+	}
+	if walker.Err() != nil {
+		t.Fatal(walker.Err())
+	}
+	if n != 3 {
+		t.Errorf("walked %d items, want limit of 3", n)
+	}
+}
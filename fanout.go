@@ -0,0 +1,109 @@
+package apub
+
+import (
+	"context"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Fanout sends an activity to many inboxes concurrently.
+// The zero value is ready to use with DefaultClient.
+type Fanout struct {
+	// Client sends each activity. If nil, DefaultClient is used.
+	Client *Client
+	// MaxWorkers is the maximum number of deliveries in flight.
+	// If zero, DefaultMaxWorkers is used.
+	MaxWorkers int
+	// MaxPerHost is the maximum number of deliveries in flight
+	// to any one host, so that large instances with many
+	// recipients on them aren't hammered by us.
+	// If zero, DefaultMaxPerHost is used.
+	MaxPerHost int
+	// Timeout, if non-zero, limits the duration of each delivery.
+	Timeout time.Duration
+}
+
+const (
+	DefaultMaxWorkers = 16
+	DefaultMaxPerHost = 2
+)
+
+// Delivery is the result of sending an activity to an inbox.
+type Delivery struct {
+	Inbox string
+	// Err is the error from sending, or nil on success.
+	// Errors from the remote server are of type *StatusError.
+	Err error
+}
+
+// Send sends activity to each inbox, returning one Delivery per inbox
+// in the same order as inboxes.
+// It returns once all deliveries have completed or ctx is done.
+func (f *Fanout) Send(ctx context.Context, activity *Activity, inboxes []string) []Delivery {
+	client := f.Client
+	if client == nil {
+		client = &DefaultClient
+	}
+	workers := f.MaxWorkers
+	if workers <= 0 {
+		workers = DefaultMaxWorkers
+	}
+	perHost := f.MaxPerHost
+	if perHost <= 0 {
+		perHost = DefaultMaxPerHost
+	}
+
+	results := make([]Delivery, len(inboxes))
+	sem := make(chan struct{}, workers)
+	var mu sync.Mutex
+	hosts := make(map[string]chan struct{})
+	hostSem := func(inbox string) chan struct{} {
+		var host string
+		if u, err := url.Parse(inbox); err == nil {
+			host = u.Host
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if hosts[host] == nil {
+			hosts[host] = make(chan struct{}, perHost)
+		}
+		return hosts[host]
+	}
+
+	var wg sync.WaitGroup
+	for i := range inboxes {
+		results[i].Inbox = inboxes[i]
+		wg.Add(1)
+		go func(d *Delivery) {
+			defer wg.Done()
+			hsem := hostSem(d.Inbox)
+			// Acquire the host's slot first so that a busy host
+			// doesn't tie up workers others could be using.
+			select {
+			case hsem <- struct{}{}:
+			case <-ctx.Done():
+				d.Err = ctx.Err()
+				return
+			}
+			defer func() { <-hsem }()
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				d.Err = ctx.Err()
+				return
+			}
+			defer func() { <-sem }()
+
+			sctx := ctx
+			if f.Timeout > 0 {
+				var cancel context.CancelFunc
+				sctx, cancel = context.WithTimeout(ctx, f.Timeout)
+				defer cancel()
+			}
+			_, d.Err = client.SendContext(sctx, d.Inbox, activity)
+		}(&results[i])
+	}
+	wg.Wait()
+	return results
+}
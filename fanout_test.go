@@ -0,0 +1,61 @@
+package apub
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFanout(t *testing.T) {
+	var mu sync.Mutex
+	var inflight, peak int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		inflight++
+		if inflight > peak {
+			peak = inflight
+		}
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		inflight--
+		mu.Unlock()
+		if req.URL.Path == "/gone/inbox" {
+			w.WriteHeader(http.StatusGone)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	var inboxes []string
+	for i := 0; i < 10; i++ {
+		inboxes = append(inboxes, fmt.Sprintf("%s/%d/inbox", srv.URL, i))
+	}
+	inboxes = append(inboxes, srv.URL+"/gone/inbox")
+	f := &Fanout{Client: &Client{Client: srv.Client()}, MaxPerHost: 3}
+	activity := &Activity{ID: "https://example.com/1", Type: "Note"}
+	deliveries := f.Send(context.Background(), activity, inboxes)
+	if len(deliveries) != len(inboxes) {
+		t.Fatalf("got %d deliveries, want %d", len(deliveries), len(inboxes))
+	}
+	for i, d := range deliveries {
+		if d.Inbox != inboxes[i] {
+			t.Errorf("delivery %d: inbox %s, want %s", i, d.Inbox, inboxes[i])
+		}
+		if d.Inbox == srv.URL+"/gone/inbox" {
+			if d.Err == nil {
+				t.Errorf("%s: expected error", d.Inbox)
+			}
+		} else if d.Err != nil {
+			t.Errorf("%s: %v", d.Inbox, d.Err)
+		}
+	}
+	if peak > 3 {
+		t.Errorf("%d concurrent deliveries to one host, want at most 3", peak)
+	}
+}
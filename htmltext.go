@@ -0,0 +1,329 @@
+package apub
+
+import (
+	"fmt"
+	"html"
+	"net/url"
+	"strings"
+	"unicode"
+)
+
+// htmlToText renders the HTML content of a post as plain text for reading in mail.
+// Paragraphs are separated by blank lines, quotes are prefixed by "> ",
+// and list items by "- " or their number.
+// Links are written as footnote references, listed after the text,
+// except where the text of the link is the link itself.
+// Mentions and hashtags are written as "@user@host" and "#tag".
+func htmlToText(s string) string {
+	r := &textRenderer{}
+	for len(s) > 0 {
+		i := strings.IndexByte(s, '<')
+		if i < 0 {
+			r.text(html.UnescapeString(s))
+			break
+		}
+		if i > 0 {
+			r.text(html.UnescapeString(s[:i]))
+		}
+		s = s[i:]
+		if strings.HasPrefix(s, "<!--") {
+			end := strings.Index(s, "-->")
+			if end < 0 {
+				break
+			}
+			s = s[end+len("-->"):]
+			continue
+		}
+		var t tag
+		t, s = parseTag(s)
+		r.tag(t)
+	}
+	return r.String()
+}
+
+type tag struct {
+	name    string
+	closing bool
+	attr    map[string]string
+}
+
+// parseTag parses the tag at the start of s, returning the rest of s.
+// Malformed tags are parsed as best we can;
+// there's no point failing to read a post over it.
+func parseTag(s string) (t tag, rest string) {
+	s = s[1:] // '<'
+	if strings.HasPrefix(s, "/") {
+		t.closing = true
+		s = s[1:]
+	}
+	i := strings.IndexAny(s, " \t\r\n/>")
+	if i < 0 {
+		return tag{}, ""
+	}
+	t.name = strings.ToLower(s[:i])
+	s = s[i:]
+	t.attr = make(map[string]string)
+	for {
+		s = strings.TrimLeft(s, " \t\r\n/")
+		if s == "" {
+			return t, ""
+		}
+		if s[0] == '>' {
+			return t, s[1:]
+		}
+		i := strings.IndexAny(s, " \t\r\n=/>")
+		if i < 0 {
+			return t, ""
+		}
+		name := strings.ToLower(s[:i])
+		s = s[i:]
+		if s[0] != '=' {
+			t.attr[name] = ""
+			continue
+		}
+		s = s[1:]
+		var val string
+		if s != "" && (s[0] == '"' || s[0] == '\'') {
+			end := strings.IndexByte(s[1:], s[0])
+			if end < 0 {
+				return t, ""
+			}
+			val, s = s[1:end+1], s[end+2:]
+		} else {
+			end := strings.IndexAny(s, " \t\r\n>")
+			if end < 0 {
+				end = len(s)
+			}
+			val, s = s[:end], s[end:]
+		}
+		t.attr[name] = html.UnescapeString(val)
+	}
+}
+
+type textRenderer struct {
+	b strings.Builder
+	// newlines is the number of line breaks to write before any more text.
+	// Blank lines among them are quoted to the depth breakQuote.
+	newlines   int
+	breakQuote int
+	// lineStart is whether nothing has been written on the current line.
+	lineStart bool
+	quote     int
+	pre       bool
+	// lists holds the number of the last item of each open list;
+	// unordered lists are -1.
+	lists []int
+	// link is the link being read, if any.
+	link  *textLink
+	links []string
+}
+
+type textLink struct {
+	href  string
+	class string
+	text  strings.Builder
+}
+
+func (r *textRenderer) tag(t tag) {
+	switch t.name {
+	case "p", "div", "h1", "h2", "h3", "h4", "h5", "h6", "ul", "ol", "table":
+		r.breakLines(2)
+	case "br", "tr", "hr":
+		if !t.closing {
+			r.breakLines(1)
+		}
+	case "blockquote":
+		r.breakLines(2)
+		if t.closing {
+			// stray closing tags are common enough in the wild.
+			if r.quote > 0 {
+				r.quote--
+			}
+			if r.breakQuote < 0 {
+				r.breakQuote = 0
+			}
+		} else {
+			r.quote++
+		}
+	case "pre":
+		r.breakLines(2)
+		r.pre = !t.closing
+	case "li":
+		if t.closing || len(r.lists) == 0 {
+			r.breakLines(1)
+			return
+		}
+		r.breakLines(1)
+		n := &r.lists[len(r.lists)-1]
+		if *n < 0 {
+			r.write("- ")
+		} else {
+			*n++
+			r.write(fmt.Sprintf("%d. ", *n))
+		}
+	case "img":
+		if alt := t.attr["alt"]; alt != "" {
+			r.text("[" + alt + "]")
+		}
+	case "a":
+		if !t.closing {
+			r.link = &textLink{href: t.attr["href"], class: t.attr["class"]}
+			return
+		}
+		if r.link != nil {
+			l := r.link
+			r.link = nil
+			r.write(r.linkText(l))
+		}
+	}
+	switch {
+	case t.name == "ul" && !t.closing:
+		r.lists = append(r.lists, -1)
+	case t.name == "ol" && !t.closing:
+		r.lists = append(r.lists, 0)
+	case (t.name == "ul" || t.name == "ol") && len(r.lists) > 0:
+		r.lists = r.lists[:len(r.lists)-1]
+	}
+}
+
+// linkText returns the text to write for l, noting it as a footnote if needed.
+func (r *textRenderer) linkText(l *textLink) string {
+	text := strings.TrimSpace(l.text.String())
+	if l.href == "" {
+		return text
+	}
+	classes := strings.Fields(l.class)
+	has := func(class string) bool {
+		for _, c := range classes {
+			if c == class {
+				return true
+			}
+		}
+		return false
+	}
+	switch {
+	case has("hashtag") || strings.HasPrefix(text, "#"):
+		return text
+	case has("mention") || strings.HasPrefix(text, "@"):
+		// Mastodon shows only the username, but the host matters.
+		u, err := url.Parse(l.href)
+		if err != nil || strings.Count(text, "@") > 1 {
+			return text
+		}
+		if !strings.HasPrefix(text, "@") {
+			text = "@" + text
+		}
+		return text + "@" + u.Host
+	case text == "" || text == l.href || "https://"+text == l.href || "http://"+text == l.href:
+		return l.href
+	}
+	r.links = append(r.links, l.href)
+	return fmt.Sprintf("%s[%d]", text, len(r.links))
+}
+
+// text writes the text s as found between tags.
+// Outside of preformatted text, runs of whitespace are collapsed to one space.
+func (r *textRenderer) text(s string) {
+	if !r.pre {
+		s = collapseSpace(s)
+	}
+	if r.link != nil {
+		r.link.text.WriteString(s)
+		return
+	}
+	r.write(s)
+}
+
+func collapseSpace(s string) string {
+	var b strings.Builder
+	var space bool
+	for _, c := range s {
+		if unicode.IsSpace(c) {
+			space = true
+			continue
+		}
+		if space {
+			b.WriteByte(' ')
+			space = false
+		}
+		b.WriteRune(c)
+	}
+	if space {
+		b.WriteByte(' ')
+	}
+	return b.String()
+}
+
+func (r *textRenderer) breakLines(n int) {
+	if r.b.Len() == 0 {
+		return
+	}
+	if r.newlines == 0 || r.quote < r.breakQuote {
+		r.breakQuote = r.quote
+	}
+	if n > r.newlines {
+		r.newlines = n
+	}
+}
+
+// write writes s, starting any pending lines first.
+func (r *textRenderer) write(s string) {
+	if s == "" {
+		return
+	}
+	if !r.pre && strings.TrimSpace(s) == "" && (r.newlines > 0 || r.lineStart) {
+		// whitespace between blocks.
+		return
+	}
+	if r.newlines > 0 {
+		for i := 0; i < r.newlines; i++ {
+			r.b.WriteString("\n")
+			if i < r.newlines-1 {
+				r.b.WriteString(strings.TrimSpace(strings.Repeat("> ", r.breakQuote)))
+			}
+		}
+		r.newlines = 0
+		r.lineStart = true
+	}
+	if !r.pre && strings.HasPrefix(s, " ") && strings.HasSuffix(r.b.String(), " ") {
+		s = s[1:]
+	}
+	if r.b.Len() == 0 {
+		r.lineStart = true
+	}
+	for i, line := range strings.Split(s, "\n") {
+		if i > 0 {
+			r.b.WriteString("\n")
+			r.lineStart = true
+		}
+		if r.lineStart {
+			if !r.pre {
+				line = strings.TrimLeft(line, " ")
+			}
+			if line == "" {
+				continue
+			}
+			r.b.WriteString(strings.Repeat("> ", r.quote))
+			r.lineStart = false
+		}
+		r.b.WriteString(line)
+	}
+}
+
+func (r *textRenderer) String() string {
+	var lines []string
+	for _, line := range strings.Split(r.b.String(), "\n") {
+		lines = append(lines, strings.TrimRight(line, " "))
+	}
+	text := strings.TrimSpace(strings.Join(lines, "\n"))
+	if len(r.links) == 0 {
+		return text + "\n"
+	}
+	buf := &strings.Builder{}
+	buf.WriteString(text)
+	buf.WriteString("\n\n")
+	for i, l := range r.links {
+		fmt.Fprintf(buf, "[%d]: %s\n", i+1, l)
+	}
+	return buf.String()
+}
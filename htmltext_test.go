@@ -0,0 +1,57 @@
+package apub
+
+import "testing"
+
+func TestHTMLToText(t *testing.T) {
+	tests := []struct {
+		name string
+		html string
+		want string
+	}{
+		{
+			"paragraphs",
+			"<p>hello</p>\n<p>world<br>again</p>",
+			"hello\n\nworld\nagain\n",
+		},
+		{
+			"mastodon mention and hashtag",
+			`<p><span class="h-card"><a href="https://hachyderm.io/@otl" class="u-url mention">@<span>otl</span></a></span> hi <a href="https://hachyderm.io/tags/go" class="mention hashtag" rel="tag">#<span>go</span></a></p>`,
+			"@otl@hachyderm.io hi #go\n",
+		},
+		{
+			"link footnotes",
+			`<p>see <a href="https://example.com/a">this</a> and <a href="https://example.com/b">that</a></p>`,
+			"see this[1] and that[2]\n\n[1]: https://example.com/a\n[2]: https://example.com/b\n",
+		},
+		{
+			"mastodon shortened link",
+			`<p><a href="https://example.com/a/long/path" rel="nofollow noopener" target="_blank"><span class="invisible">https://</span><span class="ellipsis">example.com/a/lo</span><span class="invisible">ng/path</span></a></p>`,
+			"https://example.com/a/long/path\n",
+		},
+		{
+			"quote",
+			"<blockquote><p>one &amp; two</p><p>three</p></blockquote><p>reply</p>",
+			"> one & two\n>\n> three\n\nreply\n",
+		},
+		{
+			"stray quote end",
+			"</blockquote>x<blockquote>y</blockquote>",
+			"x\n\n> y\n",
+		},
+		{
+			"lists",
+			"<ul><li>a</li><li>b</li></ul><ol><li>c</li><li>d</li></ol>",
+			"- a\n- b\n\n1. c\n2. d\n",
+		},
+		{
+			"preformatted",
+			"<p>code:</p><pre>if x {\n\treturn\n}</pre>",
+			"code:\n\nif x {\n\treturn\n}\n",
+		},
+	}
+	for _, tt := range tests {
+		if got := htmlToText(tt.html); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package sys
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path"
+	"strings"
+
+	"olowe.co/apub"
+)
+
+// ActorSet is a set of Actors stored in a file, such as a user's followers.
+// Each line of the file holds an Actor's ID, its inbox and,
+// if it has one, its shared inbox, separated by spaces.
+type ActorSet struct {
+	name string
+}
+
+// OpenFollowers opens the set of Actors following the named user.
+func OpenFollowers(username string) (*ActorSet, error) {
+	u, err := user.Lookup(username)
+	if err != nil {
+		return nil, fmt.Errorf("lookup user: %w", err)
+	}
+	return &ActorSet{path.Join(UserDataDir(u), "followers")}, nil
+}
+
+// OpenFollowing opens the set of Actors followed by the named user.
+func OpenFollowing(username string) (*ActorSet, error) {
+	u, err := user.Lookup(username)
+	if err != nil {
+		return nil, fmt.Errorf("lookup user: %w", err)
+	}
+	return &ActorSet{path.Join(UserDataDir(u), "following")}, nil
+}
+
+// Actors returns the Actors in the set.
+// Only the ID, Inbox and Endpoints fields of each Actor are populated.
+func (s *ActorSet) Actors() ([]apub.Actor, error) {
+	b, err := os.ReadFile(s.name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var actors []apub.Actor
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		a := apub.Actor{ID: fields[0], Inbox: fields[1]}
+		if len(fields) > 2 {
+			a.Endpoints.SharedInbox = fields[2]
+		}
+		actors = append(actors, a)
+	}
+	return actors, sc.Err()
+}
+
+// Contains reports whether the Actor with the given ID is in the set.
+func (s *ActorSet) Contains(id string) (bool, error) {
+	actors, err := s.Actors()
+	if err != nil {
+		return false, err
+	}
+	for i := range actors {
+		if actors[i].ID == id {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Add adds actor to the set, replacing any existing entry with the same ID.
+func (s *ActorSet) Add(actor *apub.Actor) error {
+	if actor.ID == "" || actor.Inbox == "" {
+		return fmt.Errorf("actor missing id or inbox")
+	}
+	unlock, err := lock(s.name)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	actors, err := s.Actors()
+	if err != nil {
+		return err
+	}
+	a := apub.Actor{ID: actor.ID, Inbox: actor.Inbox, Endpoints: actor.Endpoints}
+	for i := range actors {
+		if actors[i].ID == actor.ID {
+			actors[i] = a
+			return s.write(actors)
+		}
+	}
+	return s.write(append(actors, a))
+}
+
+// Remove removes the Actor with the given ID from the set, if present.
+func (s *ActorSet) Remove(id string) error {
+	unlock, err := lock(s.name)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	actors, err := s.Actors()
+	if err != nil {
+		return err
+	}
+	for i := range actors {
+		if actors[i].ID == id {
+			return s.write(append(actors[:i], actors[i+1:]...))
+		}
+	}
+	return nil
+}
+
+func (s *ActorSet) write(actors []apub.Actor) error {
+	buf := &bytes.Buffer{}
+	for _, a := range actors {
+		fmt.Fprint(buf, a.ID, " ", a.Inbox)
+		if a.Endpoints.SharedInbox != "" {
+			fmt.Fprint(buf, " ", a.Endpoints.SharedInbox)
+		}
+		fmt.Fprintln(buf)
+	}
+	tmp := path.Join(path.Dir(s.name), "."+path.Base(s.name)+".tmp")
+	if err := os.WriteFile(tmp, buf.Bytes(), 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.name)
+}
@@ -0,0 +1,43 @@
+package sys
+
+import (
+	"path"
+	"testing"
+
+	"olowe.co/apub"
+)
+
+func TestActorSet(t *testing.T) {
+	set := &ActorSet{path.Join(t.TempDir(), "followers")}
+	actors, err := set.Actors()
+	if err != nil || len(actors) > 0 {
+		t.Fatalf("empty set: got %v, %v", actors, err)
+	}
+	alice := &apub.Actor{ID: "https://example.com/alice", Inbox: "https://example.com/alice/inbox"}
+	bob := &apub.Actor{ID: "https://example.com/bob", Inbox: "https://example.com/bob/inbox"}
+	bob.Endpoints.SharedInbox = "https://example.com/inbox"
+	for _, a := range []*apub.Actor{alice, bob, alice} {
+		if err := set.Add(a); err != nil {
+			t.Fatal(err)
+		}
+	}
+	actors, err = set.Actors()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(actors) != 2 {
+		t.Fatalf("want 2 actors, got %d", len(actors))
+	}
+	if actors[1].Endpoints.SharedInbox != bob.Endpoints.SharedInbox {
+		t.Errorf("shared inbox not stored: got %q", actors[1].Endpoints.SharedInbox)
+	}
+	if err := set.Remove(alice.ID); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := set.Contains(alice.ID); ok || err != nil {
+		t.Errorf("alice still in set after removal: %v", err)
+	}
+	if ok, _ := set.Contains(bob.ID); !ok {
+		t.Errorf("bob missing from set")
+	}
+}
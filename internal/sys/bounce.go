@@ -0,0 +1,119 @@
+package sys
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"strings"
+	"time"
+
+	"olowe.co/apub"
+)
+
+// Failure is a failed delivery to Recipient,
+// which is either a mail address or the URL of an inbox.
+type Failure struct {
+	Recipient string
+	Err       error
+}
+
+// Bounce returns a delivery status notification, as described in RFC 3464,
+// reporting failures to the mail address to.
+// domain is the name of the system reporting the failures.
+// If original is not empty, the original message is quoted in full.
+func Bounce(domain, to string, original []byte, failures []Failure) ([]byte, error) {
+	body := &bytes.Buffer{}
+	w := multipart.NewWriter(body)
+
+	hdr := make(textproto.MIMEHeader)
+	hdr.Set("Content-Type", "text/plain; charset=utf-8")
+	part, err := w.CreatePart(hdr)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(part, "This is the mail system at %s.\r\n\r\n", domain)
+	fmt.Fprint(part, "Your message could not be delivered to the following recipients:\r\n\r\n")
+	for _, f := range failures {
+		fmt.Fprintf(part, "\t%s: %v\r\n", f.Recipient, f.Err)
+	}
+
+	hdr = make(textproto.MIMEHeader)
+	hdr.Set("Content-Type", "message/delivery-status")
+	part, err = w.CreatePart(hdr)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(part, "Reporting-MTA: dns; %s\r\n", domain)
+	fmt.Fprintf(part, "Arrival-Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	for _, f := range failures {
+		fmt.Fprint(part, "\r\n")
+		if strings.Contains(f.Recipient, "://") {
+			fmt.Fprintf(part, "Final-Recipient: X-ActivityPub; %s\r\n", f.Recipient)
+		} else {
+			fmt.Fprintf(part, "Final-Recipient: rfc822; %s\r\n", f.Recipient)
+		}
+		fmt.Fprint(part, "Action: failed\r\n")
+		fmt.Fprintf(part, "Status: %s\r\n", statusCode(f.Err))
+		var serr *apub.StatusError
+		if errors.As(f.Err, &serr) {
+			fmt.Fprintf(part, "Diagnostic-Code: X-HTTP; %s\r\n", serr.Status)
+		}
+	}
+
+	if len(original) > 0 {
+		hdr = make(textproto.MIMEHeader)
+		hdr.Set("Content-Type", "message/rfc822")
+		part, err = w.CreatePart(hdr)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.Copy(part, bytes.NewReader(original)); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "From: Mail Delivery System <MAILER-DAEMON@%s>\r\n", domain)
+	fmt.Fprintf(buf, "To: <%s>\r\n", to)
+	fmt.Fprint(buf, "Subject: Undelivered Mail Returned to Sender\r\n")
+	fmt.Fprintf(buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(buf, "Message-ID: <%d.%d.bounce@%s>\r\n", time.Now().UnixNano(), os.Getpid(), domain)
+	fmt.Fprint(buf, "Auto-Submitted: auto-replied\r\n")
+	fmt.Fprint(buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(buf, "Content-Type: multipart/report; report-type=delivery-status; boundary=%q\r\n", w.Boundary())
+	fmt.Fprint(buf, "\r\n")
+	buf.Write(body.Bytes())
+	return buf.Bytes(), nil
+}
+
+// statusCode returns the enhanced mail status code,
+// as described in RFC 3463, best describing err.
+func statusCode(err error) string {
+	var uerr *UndeliverableError
+	if errors.As(err, &uerr) && uerr.Expired {
+		return "5.4.7" // delivery time expired
+	}
+	if errors.Is(err, apub.ErrNotExist) {
+		return "5.1.1" // bad destination mailbox address
+	}
+	var serr *apub.StatusError
+	if errors.As(err, &serr) {
+		switch serr.StatusCode {
+		case http.StatusNotFound:
+			return "5.1.1"
+		case http.StatusGone:
+			return "5.1.6" // destination mailbox has moved
+		case http.StatusUnauthorized, http.StatusForbidden:
+			return "5.7.1" // delivery not authorized
+		}
+	}
+	return "5.0.0"
+}
@@ -0,0 +1,69 @@
+package sys
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+	"testing"
+
+	"olowe.co/apub"
+)
+
+func TestBounce(t *testing.T) {
+	original := "From: otl@example.com\r\nTo: nobody@example.org\r\nSubject: hello\r\n\r\nhello, world!\r\n"
+	failures := []Failure{
+		{"nobody@example.org", fmt.Errorf("webfinger: %w", apub.ErrNotExist)},
+		{"https://example.net/inbox", &apub.StatusError{StatusCode: 410, Status: "410 Gone"}},
+		{"https://example.com/inbox", &UndeliverableError{Err: &apub.StatusError{StatusCode: 503, Status: "503 Service Unavailable"}, Expired: true}},
+	}
+	b, err := Bounce("example.com", "otl@example.com", []byte(original), failures)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mtype, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mtype != "multipart/report" || params["report-type"] != "delivery-status" {
+		t.Fatalf("content type %s, report type %s", mtype, params["report-type"])
+	}
+	r := multipart.NewReader(msg.Body, params["boundary"])
+	var types []string
+	for {
+		part, err := r.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctype := part.Header.Get("Content-Type")
+		types = append(types, ctype)
+		switch ctype {
+		case "message/delivery-status":
+			for _, want := range []string{"Status: 5.1.1", "Status: 5.1.6", "Status: 5.4.7", "Final-Recipient: X-ActivityPub; https://example.net/inbox"} {
+				if !strings.Contains(string(body), want) {
+					t.Errorf("delivery status missing %q", want)
+				}
+			}
+		case "message/rfc822":
+			if string(body) != original {
+				t.Errorf("original message not quoted verbatim: %q", body)
+			}
+		}
+	}
+	if len(types) != 3 {
+		t.Errorf("want 3 parts, got %v", types)
+	}
+}
@@ -0,0 +1,311 @@
+package sys
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/mail"
+	"os"
+	"os/user"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"olowe.co/apub"
+)
+
+// Pending holds follow requests awaiting approval by a user.
+// Each request is stored as a file in the pending directory.
+type Pending struct {
+	dir string
+}
+
+// OpenPending opens the pending follow requests of the named user,
+// creating the directory holding them if necessary.
+func OpenPending(username string) (*Pending, error) {
+	u, err := user.Lookup(username)
+	if err != nil {
+		return nil, fmt.Errorf("lookup user: %w", err)
+	}
+	dir := path.Join(UserDataDir(u), "pending")
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &Pending{dir}, nil
+}
+
+// Add records follow as awaiting approval.
+func (p *Pending) Add(follow *apub.Activity) error {
+	b, err := json.Marshal(follow)
+	if err != nil {
+		return fmt.Errorf("encode follow: %w", err)
+	}
+	// written whole, as apsend may read it while apserve writes it.
+	name := p.file(follow.ID)
+	tmp := path.Join(p.dir, "."+path.Base(name)+".tmp")
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+// Get returns the pending follow request with the given ID.
+// If there is no such request, the error wraps os.ErrNotExist.
+func (p *Pending) Get(id string) (*apub.Activity, error) {
+	f, err := os.Open(p.file(id))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return apub.Decode(f)
+}
+
+// Remove removes the pending follow request with the given ID, if any.
+func (p *Pending) Remove(id string) error {
+	err := os.Remove(p.file(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// Response returns the pending follow request which msg replies to,
+// and whether msg accepts or rejects it.
+// The first line of the reply must begin with "accept" or "reject".
+// Only a reply from the address of the user themselves, from,
+// is a response; for any other message, such as the follower's own
+// reply to their request, the returned follow is nil
+// and the message should be delivered as usual.
+func (p *Pending) Response(msg *mail.Message, from string) (follow *apub.Activity, accept bool, err error) {
+	irt := strings.Trim(msg.Header.Get("In-Reply-To"), "<> ")
+	if irt == "" {
+		return nil, false, nil
+	}
+	sender, err := mail.ParseAddress(msg.Header.Get("From"))
+	if err != nil || !strings.EqualFold(sender.Address, from) {
+		return nil, false, nil
+	}
+	follow, err = p.Get(irt)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, fmt.Errorf("read pending follow request: %w", err)
+	}
+
+	sc := bufio.NewScanner(msg.Body)
+	for sc.Scan() {
+		line := strings.ToLower(strings.TrimSpace(sc.Text()))
+		if line == "" || strings.HasPrefix(line, ">") {
+			continue
+		}
+		if strings.HasPrefix(line, "accept") {
+			return follow, true, nil
+		} else if strings.HasPrefix(line, "reject") {
+			return follow, false, nil
+		}
+		break
+	}
+	return follow, false, fmt.Errorf("reply to %s must begin with accept or reject", irt)
+}
+
+func (p *Pending) file(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return path.Join(p.dir, hex.EncodeToString(sum[:16])+".json")
+}
+
+// RespondFollow accepts or rejects follow, a request to follow
+// the named user on host, by sending an Accept or Reject activity to its actor.
+// If accepted, the actor is added to the user's followers.
+// The response is sent with Deliver.
+func RespondFollow(ctx context.Context, client *apub.Client, username, host string, follow *apub.Activity, accept bool) error {
+	me, err := Actor(username, host)
+	if err != nil {
+		return fmt.Errorf("load actor: %w", err)
+	}
+	follower, err := client.LookupActorContext(ctx, follow.Actor)
+	if err != nil {
+		return fmt.Errorf("lookup follower %s: %w", follow.Actor, err)
+	}
+	if accept {
+		followers, err := OpenFollowers(username)
+		if err != nil {
+			return err
+		}
+		if err := followers.Add(follower); err != nil {
+			return fmt.Errorf("add follower: %w", err)
+		}
+	}
+
+	object, err := json.Marshal(follow)
+	if err != nil {
+		return fmt.Errorf("encode follow: %w", err)
+	}
+	typ := "Reject"
+	if accept {
+		typ = "Accept"
+	}
+	sum := sha256.Sum256([]byte(follow.ID))
+	now := time.Now()
+	response := &apub.Activity{
+		AtContext: apub.NormContext,
+		ID:        me.Outbox + "/" + strings.ToLower(typ) + "-" + hex.EncodeToString(sum[:8]),
+		Type:      typ,
+		Actor:     me.ID,
+		To:        []string{follower.ID},
+		Published: &now,
+		Object:    object,
+	}
+	if err := AppendToOutbox(username, response); err != nil {
+		return fmt.Errorf("append %s to outbox: %w", typ, err)
+	}
+	return Deliver(ctx, client, username, follower.Inbox, response)
+}
+
+// Deliver sends activity to inbox on behalf of the named user.
+// Like apsend, the delivery is queued first
+// so that temporary failures are retried later by apserve;
+// only permanent failures are returned.
+func Deliver(ctx context.Context, client *apub.Client, username, inbox string, activity *apub.Activity) error {
+	queue, err := OpenQueue(username)
+	if err != nil {
+		return fmt.Errorf("open delivery queue: %w", err)
+	}
+	item, err := queue.Enqueue(inbox, activity, nil)
+	if err != nil {
+		return fmt.Errorf("queue %s: %w", activity.Type, err)
+	}
+	err = queue.Deliver(ctx, client, item)
+	if err != nil && !errors.Is(err, ErrUndeliverable) {
+		return nil // retried later
+	}
+	return err
+}
+
+// Status of a FollowRequest.
+const (
+	FollowPending  = "pending"
+	FollowAccepted = "accepted"
+	FollowRejected = "rejected"
+)
+
+// FollowRequest is a request by a local user to follow an Actor.
+type FollowRequest struct {
+	// Object is the ID of the followed Actor.
+	Object  string         `json:"object"`
+	Follow  *apub.Activity `json:"follow"`
+	Status  string         `json:"status"`
+	Updated time.Time      `json:"updated"`
+}
+
+// FollowRequests holds the follow requests sent by a user
+// and whether they have been accepted.
+// Each request is stored as a file in the follows directory.
+type FollowRequests struct {
+	dir string
+}
+
+// OpenFollowRequests opens the follow requests sent by the named user,
+// creating the directory holding them if necessary.
+func OpenFollowRequests(username string) (*FollowRequests, error) {
+	u, err := user.Lookup(username)
+	if err != nil {
+		return nil, fmt.Errorf("lookup user: %w", err)
+	}
+	dir := path.Join(UserDataDir(u), "follows")
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &FollowRequests{dir}, nil
+}
+
+// Put records req, replacing any request to follow the same Actor.
+func (r *FollowRequests) Put(req *FollowRequest) error {
+	req.Updated = time.Now()
+	b, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	name := r.file(req.Object)
+	tmp := path.Join(r.dir, "."+path.Base(name)+".tmp")
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+// Get returns the request to follow the Actor with the given ID.
+// If there is no such request, the error wraps os.ErrNotExist.
+func (r *FollowRequests) Get(object string) (*FollowRequest, error) {
+	b, err := os.ReadFile(r.file(object))
+	if err != nil {
+		return nil, err
+	}
+	var req FollowRequest
+	if err := json.Unmarshal(b, &req); err != nil {
+		return nil, err
+	}
+	return &req, nil
+}
+
+// All returns all follow requests, most recently updated first.
+func (r *FollowRequests) All() ([]FollowRequest, error) {
+	dirents, err := os.ReadDir(r.dir)
+	if err != nil {
+		return nil, err
+	}
+	var reqs []FollowRequest
+	for _, d := range dirents {
+		if d.IsDir() || strings.HasPrefix(d.Name(), ".") {
+			continue
+		}
+		b, err := os.ReadFile(path.Join(r.dir, d.Name()))
+		if err != nil {
+			return reqs, err
+		}
+		var req FollowRequest
+		if err := json.Unmarshal(b, &req); err != nil {
+			return reqs, fmt.Errorf("%s: %w", d.Name(), err)
+		}
+		reqs = append(reqs, req)
+	}
+	sort.Slice(reqs, func(i, j int) bool { return reqs[i].Updated.After(reqs[j].Updated) })
+	return reqs, nil
+}
+
+// Remove removes the request to follow the Actor with the given ID, if any.
+func (r *FollowRequests) Remove(object string) error {
+	err := os.Remove(r.file(object))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (r *FollowRequests) file(object string) string {
+	sum := sha256.Sum256([]byte(object))
+	return path.Join(r.dir, hex.EncodeToString(sum[:16])+".json")
+}
+
+// FollowRequestMail returns a mail message to the user with the address to
+// asking them to approve follow, a request from follower.
+// The message's ID is the ID of follow,
+// so that replies reference the request in their In-Reply-To line.
+func FollowRequestMail(to string, follower *apub.Actor, follow *apub.Activity) []byte {
+	buf := &bytes.Buffer{}
+	from := follower.Address()
+	fmt.Fprintf(buf, "From: %s\r\n", from)
+	fmt.Fprintf(buf, "To: <%s>\r\n", to)
+	fmt.Fprintf(buf, "Subject: Follow request from %s\r\n", from.Address)
+	fmt.Fprintf(buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(buf, "Message-ID: <%s>\r\n", follow.ID)
+	fmt.Fprint(buf, "\r\n")
+	fmt.Fprintf(buf, "%s (%s) would like to follow you.\r\n\r\n", from.Address, follower.ID)
+	fmt.Fprint(buf, "Reply to this message with \"accept\" or \"reject\" on the first line.\r\n")
+	return buf.Bytes()
+}
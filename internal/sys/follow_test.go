@@ -0,0 +1,100 @@
+package sys
+
+import (
+	"errors"
+	"net/mail"
+	"os"
+	"strings"
+	"testing"
+
+	"olowe.co/apub"
+)
+
+func TestFollowRequests(t *testing.T) {
+	requests := &FollowRequests{t.TempDir()}
+	alice := "https://example.com/alice"
+	follow := &apub.Activity{ID: "https://apas.example.org/bowie/outbox/follow-1", Type: "Follow"}
+	req := &FollowRequest{Object: alice, Follow: follow, Status: FollowPending}
+	if err := requests.Put(req); err != nil {
+		t.Fatal(err)
+	}
+	req.Status = FollowAccepted
+	if err := requests.Put(req); err != nil {
+		t.Fatal(err)
+	}
+	all, err := requests.All()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 1 {
+		t.Fatalf("want 1 request, got %d", len(all))
+	}
+	got, err := requests.Get(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != FollowAccepted || got.Follow.ID != follow.ID {
+		t.Errorf("got status %q follow %q", got.Status, got.Follow.ID)
+	}
+	if err := requests.Remove(alice); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := requests.Get(alice); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("get removed request: want %v, got %v", os.ErrNotExist, err)
+	}
+	if err := requests.Remove(alice); err != nil {
+		t.Errorf("remove missing request: %v", err)
+	}
+}
+
+func TestPendingResponse(t *testing.T) {
+	pending := &Pending{t.TempDir()}
+	follow := &apub.Activity{ID: "https://example.com/bob/follow-1", Type: "Follow", Actor: "https://example.com/bob"}
+	if err := pending.Add(follow); err != nil {
+		t.Fatal(err)
+	}
+	const me = "otl@apas.example.org"
+	tests := []struct {
+		name     string
+		msg      string
+		response bool
+		accept   bool
+	}{
+		{"accept", "From: otl@apas.example.org\nIn-Reply-To: <https://example.com/bob/follow-1>\n\nAccept\n\n> follow request\n", true, true},
+		{"reject", "From: Oliver <OTL@apas.example.org>\nIn-Reply-To: <https://example.com/bob/follow-1>\n\nreject, sorry\n", true, false},
+		{"other reply", "From: otl@apas.example.org\nIn-Reply-To: <https://example.com/bob/note/1>\n\naccept\n", false, false},
+		{
+			// relayed from the follower, who may not approve themselves.
+			"relayed",
+			"From: bob@example.com\nIn-Reply-To: <https://example.com/bob/follow-1>\n\naccept\n",
+			false, false,
+		},
+	}
+	for _, tt := range tests {
+		msg, err := mail.ReadMessage(strings.NewReader(tt.msg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, accept, err := pending.Response(msg, me)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if tt.response && (got == nil || got.ID != follow.ID) {
+			t.Errorf("%s: not handled as a response to %s", tt.name, follow.ID)
+		} else if !tt.response && got != nil {
+			t.Errorf("%s: handled as a response to %s, not delivered", tt.name, got.ID)
+		}
+		if accept != tt.accept {
+			t.Errorf("%s: accept = %v, want %v", tt.name, accept, tt.accept)
+		}
+	}
+
+	msg, err := mail.ReadMessage(strings.NewReader("From: otl@apas.example.org\nIn-Reply-To: <https://example.com/bob/follow-1>\n\nmaybe later\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := pending.Response(msg, me); err == nil {
+		t.Error("undecided reply accepted as a response")
+	}
+}
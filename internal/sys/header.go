@@ -0,0 +1,66 @@
+package sys
+
+import (
+	"bytes"
+	"fmt"
+	"net/mail"
+	"strings"
+)
+
+// HeaderRecipients returns the recipients listed in the To, CC and Bcc
+// lines of a message header.
+// Addresses of users local to host are returned as plain usernames.
+func HeaderRecipients(header mail.Header, host string) ([]string, error) {
+	var rcpts []string
+	for _, key := range []string{"To", "CC", "Bcc"} {
+		if header.Get(key) == "" {
+			continue
+		}
+		alist, err := header.AddressList(key)
+		if err != nil {
+			return nil, fmt.Errorf("parse %s address list: %w", key, err)
+		}
+		for _, addr := range alist {
+			name, domain, _ := strings.Cut(addr.Address, "@")
+			if domain == host && !strings.Contains(name, "+") {
+				rcpts = append(rcpts, name)
+				continue
+			}
+			rcpts = append(rcpts, addr.Address)
+		}
+	}
+	return rcpts, nil
+}
+
+// StripHeader returns msg without any header lines named key,
+// including their continuation lines.
+func StripHeader(msg []byte, key string) []byte {
+	buf := &bytes.Buffer{}
+	var skipping bool
+	rest := msg
+	for len(rest) > 0 {
+		line := rest
+		if i := bytes.IndexByte(rest, '\n'); i >= 0 {
+			line = rest[:i+1]
+		}
+		rest = rest[len(line):]
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			// end of header
+			buf.Write(line)
+			buf.Write(rest)
+			break
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			if !skipping {
+				buf.Write(line)
+			}
+			continue
+		}
+		name, _, _ := bytes.Cut(line, []byte(":"))
+		skipping = strings.EqualFold(string(bytes.TrimSpace(name)), key)
+		if !skipping {
+			buf.Write(line)
+		}
+	}
+	return buf.Bytes()
+}
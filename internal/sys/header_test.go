@@ -0,0 +1,93 @@
+package sys
+
+import (
+	"bytes"
+	"net/mail"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestHeaderRecipients(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		want   []string
+	}{
+		{"none", "Subject: hello", nil},
+		{"to", "To: Alice <alice@example.com>", []string{"alice@example.com"}},
+		{
+			"to cc bcc",
+			"To: alice@example.com\nCC: bob@example.org, carol@example.net\nBcc: dave@example.com",
+			[]string{"alice@example.com", "bob@example.org", "carol@example.net", "dave@example.com"},
+		},
+		{"local", "To: otl@apubtest2.srcbeat.com\nBcc: Ed <ed@apubtest2.srcbeat.com>", []string{"otl", "ed"}},
+		{
+			"followers",
+			"To: otl+followers@apubtest2.srcbeat.com\nCC: alice+followers@example.com",
+			[]string{"otl+followers@apubtest2.srcbeat.com", "alice+followers@example.com"},
+		},
+	}
+	for _, tt := range tests {
+		msg, err := mail.ReadMessage(strings.NewReader(tt.header + "\n\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := HeaderRecipients(msg.Header, "apubtest2.srcbeat.com")
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	msg, err := mail.ReadMessage(strings.NewReader("To: not an address\n\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := HeaderRecipients(msg.Header, "apubtest2.srcbeat.com"); err == nil {
+		t.Errorf("no error for malformed address list")
+	}
+}
+
+func TestStripHeader(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  string
+		want string
+	}{
+		{
+			"bcc",
+			"From: otl@apubtest2.srcbeat.com\r\nBcc: alice@example.com\r\nSubject: hello\r\n\r\nhello\r\n",
+			"From: otl@apubtest2.srcbeat.com\r\nSubject: hello\r\n\r\nhello\r\n",
+		},
+		{
+			"folded",
+			"To: bob@example.org\nBCC: alice@example.com,\n\tcarol@example.net\nSubject: hello\n\nhello\n",
+			"To: bob@example.org\nSubject: hello\n\nhello\n",
+		},
+		{
+			"body untouched",
+			"Subject: hello\n\nBcc: this is the body\n",
+			"Subject: hello\n\nBcc: this is the body\n",
+		},
+		{"no bcc", "To: bob@example.org\n\nhi\n", "To: bob@example.org\n\nhi\n"},
+	}
+	for _, tt := range tests {
+		got := StripHeader([]byte(tt.msg), "Bcc")
+		if string(got) != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+			continue
+		}
+		msg, err := mail.ReadMessage(bytes.NewReader(got))
+		if err != nil {
+			t.Errorf("%s: read stripped message: %v", tt.name, err)
+			continue
+		}
+		if msg.Header.Get("Bcc") != "" {
+			t.Errorf("%s: Bcc still in header", tt.name)
+		}
+	}
+}
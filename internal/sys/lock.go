@@ -0,0 +1,45 @@
+package sys
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"time"
+)
+
+const (
+	// How long to wait for a lock held by someone else.
+	lockTimeout = 30 * time.Second
+	// A lock held longer than this is assumed to belong
+	// to a process which has since died.
+	staleLock = time.Minute
+)
+
+// lock locks the file name against modification by other processes,
+// such as apserve and apsend modifying a user's followers at once.
+// The lock is a file created next to name; creating it fails while
+// it exists, so only one process at a time may hold it.
+// The returned function releases the lock.
+func lock(name string) (unlock func(), err error) {
+	lname := path.Join(path.Dir(name), "."+path.Base(name)+".lock")
+	deadline := time.Now().Add(lockTimeout)
+	for {
+		f, err := os.OpenFile(lname, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(lname) }, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, fmt.Errorf("lock %s: %w", name, err)
+		}
+		if info, err := os.Stat(lname); err == nil && time.Since(info.ModTime()) > staleLock {
+			os.Remove(lname)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("lock %s: timed out waiting for %s", name, lname)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,56 @@
+package sys
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestLock(t *testing.T) {
+	name := path.Join(t.TempDir(), "followers")
+	unlock, err := lock(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	locked := make(chan bool)
+	go func() {
+		unlock, err := lock(name)
+		if err != nil {
+			t.Error(err)
+			close(locked)
+			return
+		}
+		unlock()
+		locked <- true
+	}()
+	select {
+	case <-locked:
+		t.Fatal("lock acquired while already held")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatal("lock not acquired after release")
+	}
+
+	// left behind by a process which died holding it.
+	lname := path.Join(path.Dir(name), ".followers.lock")
+	if err := os.WriteFile(lname, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * staleLock)
+	if err := os.Chtimes(lname, old, old); err != nil {
+		t.Fatal(err)
+	}
+	unlock, err = lock(name)
+	if err != nil {
+		t.Fatalf("stale lock not broken: %v", err)
+	}
+	unlock()
+	if _, err := os.Stat(lname); err == nil {
+		t.Errorf("lock file left after unlock")
+	}
+}
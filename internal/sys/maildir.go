@@ -0,0 +1,188 @@
+package sys
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/mail"
+	"os"
+	"os/user"
+	"path"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var deliveries uint64
+
+// MessageIndexLimit is the number of messages delivered to a user
+// which are indexed by Message-ID, so that TrashMessages can find them.
+// Older messages are not trashed.
+const MessageIndexLimit = 4 * SeenLimit
+
+// DeliverLocal delivers the mail message msg to the named user's Maildir.
+func DeliverLocal(username string, msg []byte) error {
+	u, err := user.Lookup(username)
+	if err != nil {
+		return err
+	}
+	return deliver(path.Join(u.HomeDir, "Maildir"), path.Join(UserDataDir(u), "messages"), msg)
+}
+
+// deliver delivers msg to maildir, noting its file name in the index.
+func deliver(maildir, index string, msg []byte) error {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+	// Unique names as described by the Maildir specification,
+	// so that messages delivered in the same second don't clobber each other.
+	// https://cr.yp.to/proto/maildir.html
+	n := atomic.AddUint64(&deliveries, 1)
+	now := time.Now()
+	name := fmt.Sprintf("%d.M%dP%dQ%d.%s", now.Unix(), now.Nanosecond()/1000, os.Getpid(), n, host)
+	tmp := path.Join(maildir, "tmp", name)
+	if err := os.WriteFile(tmp, msg, 0664); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path.Join(maildir, "new", name)); err != nil {
+		return err
+	}
+	// The message is delivered either way;
+	// at worst it won't be trashed if its post is deleted.
+	indexMessage(index, name, msg)
+	return nil
+}
+
+// indexMessage records the Message-ID and Supersedes headers of msg,
+// delivered to a Maildir as name, in the message index file.
+// Each line of the file holds a message ID and a file name.
+// Like a SeenIndex, it is trimmed to the most recent MessageIndexLimit.
+func indexMessage(index, name string, msg []byte) error {
+	m, err := mail.ReadMessage(bytes.NewReader(msg))
+	if err != nil {
+		return err
+	}
+	var lines []string
+	for _, key := range []string{"Message-ID", "Supersedes"} {
+		if id := strings.TrimSpace(m.Header.Get(key)); id != "" {
+			lines = append(lines, id+" "+name)
+		}
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	unlock, err := lock(index)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	known, err := readLines(index)
+	if err != nil {
+		return err
+	}
+	if len(known)+len(lines) >= 2*MessageIndexLimit {
+		known = append(known, lines...)
+		known = known[len(known)-MessageIndexLimit:]
+		tmp := path.Join(path.Dir(index), "."+path.Base(index)+".tmp")
+		if err := os.WriteFile(tmp, []byte(strings.Join(known, "\n")+"\n"), 0o600); err != nil {
+			return err
+		}
+		return os.Rename(tmp, index)
+	}
+	f, err := os.OpenFile(index, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintln(f, strings.Join(lines, "\n")); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func readLines(name string) ([]string, error) {
+	b, err := os.ReadFile(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var lines []string
+	for _, line := range strings.Split(string(b), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, nil
+}
+
+// TrashMessages flags as trashed the messages in the named user's Maildir
+// with the given Message-ID, or superseding that message,
+// returning how many were found.
+// Messages are found from the index kept by DeliverLocal,
+// so only the most recent MessageIndexLimit messages are considered.
+// Mail clients typically hide trashed messages and eventually remove them.
+func TrashMessages(username, messageID string) (int, error) {
+	u, err := user.Lookup(username)
+	if err != nil {
+		return 0, err
+	}
+	return trashMessages(path.Join(u.HomeDir, "Maildir"), path.Join(UserDataDir(u), "messages"), messageID)
+}
+
+func trashMessages(maildir, index, messageID string) (int, error) {
+	want := "<" + strings.Trim(messageID, "<>") + ">"
+	lines, err := readLines(index)
+	if err != nil {
+		return 0, fmt.Errorf("read message index: %w", err)
+	}
+	names := make(map[string]bool)
+	for _, line := range lines {
+		if id, name, ok := strings.Cut(line, " "); ok && id == want {
+			names[name] = true
+		}
+	}
+	if len(names) == 0 {
+		return 0, nil
+	}
+	// list both before moving any messages from new to cur.
+	dirents := make(map[string][]os.DirEntry)
+	for _, sub := range []string{"new", "cur"} {
+		if dirents[sub], err = os.ReadDir(path.Join(maildir, sub)); err != nil {
+			return 0, err
+		}
+	}
+	var n int
+	for _, sub := range []string{"new", "cur"} {
+		for _, d := range dirents[sub] {
+			// mail clients add flags to the unique name as they read messages.
+			unique, _, _ := strings.Cut(d.Name(), ":2,")
+			if d.IsDir() || !names[unique] {
+				continue
+			}
+			name := path.Join(maildir, sub, d.Name())
+			if err := os.Rename(name, path.Join(maildir, "cur", trashed(d.Name()))); err != nil {
+				return n, err
+			}
+			n++
+		}
+	}
+	return n, nil
+}
+
+// trashed returns the Maildir file name with the trashed flag added to name.
+// Flags are kept in ASCII order as the specification requires.
+func trashed(name string) string {
+	base, flags, ok := strings.Cut(name, ":2,")
+	if !ok {
+		return name + ":2,T"
+	}
+	if strings.Contains(flags, "T") {
+		return name
+	}
+	b := []byte(flags + "T")
+	sort.Slice(b, func(i, j int) bool { return b[i] < b[j] })
+	return base + ":2," + string(b)
+}
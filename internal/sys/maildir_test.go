@@ -0,0 +1,77 @@
+package sys
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestTrashed(t *testing.T) {
+	tests := map[string]string{
+		"1700000000.M1P2Q3.host":      "1700000000.M1P2Q3.host:2,T",
+		"1700000000.M1P2Q3.host:2,":   "1700000000.M1P2Q3.host:2,T",
+		"1700000000.M1P2Q3.host:2,FS": "1700000000.M1P2Q3.host:2,FST",
+		"1700000000.M1P2Q3.host:2,SZ": "1700000000.M1P2Q3.host:2,STZ",
+		"1700000000.M1P2Q3.host:2,ST": "1700000000.M1P2Q3.host:2,ST",
+	}
+	for name, want := range tests {
+		if got := trashed(name); got != want {
+			t.Errorf("trashed(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestTrashMessages(t *testing.T) {
+	dir := t.TempDir()
+	maildir := path.Join(dir, "Maildir")
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(path.Join(maildir, sub), 0o700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	index := path.Join(dir, "messages")
+	msgs := []string{
+		"Message-ID: <https://example.com/notes/1>\n\nhello\n",
+		"Message-ID: <https://example.com/notes/1#1700000000>\nSupersedes: <https://example.com/notes/1>\n\nhello, edited\n",
+		"Message-ID: <https://example.com/notes/2>\n\nsomething else\n",
+	}
+	for _, msg := range msgs {
+		if err := deliver(maildir, index, []byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// read by a mail client since delivery.
+	dirents, err := os.ReadDir(path.Join(maildir, "new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := dirents[0].Name()
+	if err := os.Rename(path.Join(maildir, "new", read), path.Join(maildir, "cur", read+":2,S")); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := trashMessages(maildir, index, "https://example.com/notes/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("want 2 messages trashed, got %d", n)
+	}
+	cur, err := os.ReadDir(path.Join(maildir, "cur"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ntrashed int
+	for _, d := range cur {
+		if strings.HasSuffix(d.Name(), "T") {
+			ntrashed++
+		}
+	}
+	if ntrashed != 2 {
+		t.Errorf("want 2 trashed files in cur, got %d", ntrashed)
+	}
+	if n, err := trashMessages(maildir, index, "https://example.com/notes/3"); n != 0 || err != nil {
+		t.Errorf("trash unknown message: got %d, %v", n, err)
+	}
+}
@@ -0,0 +1,77 @@
+package sys
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"os"
+	"os/user"
+	"path"
+
+	"olowe.co/apub"
+)
+
+// mediaExt maps media types of common attachments to the file extensions
+// they are stored with. The system's MIME tables are used for others,
+// but their choice varies; the extension determines the type served.
+var mediaExt = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+	"image/avif": ".avif",
+	"audio/mpeg": ".mp3",
+	"audio/ogg":  ".ogg",
+	"audio/flac": ".flac",
+	"video/mp4":  ".mp4",
+	"video/webm": ".webm",
+}
+
+// MediaType returns the media type of the stored media file name,
+// or the empty string if it is unknown.
+func MediaType(name string) string {
+	ext := path.Ext(name)
+	for typ, e := range mediaExt {
+		if e == ext {
+			return typ
+		}
+	}
+	return mime.TypeByExtension(ext)
+}
+
+// StoreMedia stores the data of att in the media directory of
+// the named user on host, and sets att.URL to where it is served.
+// Files are named by their content, so storing the same file again
+// does not copy it.
+func StoreMedia(username, host string, att *apub.Attachment) error {
+	u, err := user.Lookup(username)
+	if err != nil {
+		return fmt.Errorf("lookup user: %w", err)
+	}
+	ext, ok := mediaExt[att.MediaType]
+	if !ok {
+		exts, err := mime.ExtensionsByType(att.MediaType)
+		if err != nil || len(exts) == 0 {
+			return fmt.Errorf("unsupported media type %q", att.MediaType)
+		}
+		ext = exts[0]
+	}
+	dir := path.Join(UserDataDir(u), "media")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	sum := sha256.Sum256(att.Data)
+	name := hex.EncodeToString(sum[:16]) + ext
+	if _, err := os.Stat(path.Join(dir, name)); err != nil {
+		tmp := path.Join(dir, "."+name+".tmp")
+		if err := os.WriteFile(tmp, att.Data, 0o644); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, path.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+	att.URL = fmt.Sprintf("https://%s/%s/media/%s", host, u.Username, name)
+	return nil
+}
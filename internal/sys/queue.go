@@ -0,0 +1,349 @@
+package sys
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path"
+	"strings"
+	"time"
+
+	"olowe.co/apub"
+)
+
+// Queue is a persistent queue of activities pending delivery to remote inboxes.
+// Each pending delivery is stored as a file in the queue directory.
+// Deliveries which fail permanently, or which are still failing after
+// QueueLifetime, are moved to the "dead" subdirectory.
+// Mail messages from which activities were created are stored once
+// in the "msg" subdirectory, however many deliveries they are sent in.
+type Queue struct {
+	dir string
+}
+
+// QueueItem is a pending delivery of an activity to an inbox.
+type QueueItem struct {
+	Inbox    string          `json:"inbox"`
+	Activity json.RawMessage `json:"activity"`
+	Created  time.Time       `json:"created"`
+	Attempts int             `json:"attempts"`
+	// Next is the earliest time of the next delivery attempt.
+	Next time.Time `json:"next"`
+	// Err is the error from the last delivery attempt, if any.
+	Err string `json:"error,omitempty"`
+	// Message names the stored mail message, if any, from which
+	// the activity was created. It is quoted in bounce messages.
+	// See Queue.Message.
+	Message string `json:"msg,omitempty"`
+
+	name string
+}
+
+const (
+	// QueueLifetime is how long delivery is retried before giving up.
+	QueueLifetime = 5 * 24 * time.Hour
+	// Delay before the first retry; doubled after each failed attempt.
+	minBackoff = time.Minute
+	maxBackoff = 6 * time.Hour
+	// A claimed item not released after this long is assumed to belong
+	// to a worker which has since died.
+	staleClaim = time.Hour
+)
+
+// ErrUndeliverable is returned when a queued delivery
+// has failed permanently and has been moved out of the queue.
+var ErrUndeliverable = errors.New("undeliverable")
+
+// UndeliverableError records why a queued delivery failed permanently.
+// It matches ErrUndeliverable with errors.Is.
+type UndeliverableError struct {
+	Err error
+	// Expired is true if delivery was abandoned
+	// after failing for longer than QueueLifetime.
+	Expired bool
+}
+
+func (e *UndeliverableError) Error() string {
+	if e.Expired {
+		return fmt.Sprintf("%v: retries exhausted: %v", ErrUndeliverable, e.Err)
+	}
+	return fmt.Sprintf("%v: %v", ErrUndeliverable, e.Err)
+}
+
+func (e *UndeliverableError) Unwrap() error { return e.Err }
+
+func (e *UndeliverableError) Is(target error) bool { return target == ErrUndeliverable }
+
+// OpenQueue opens the delivery queue of the named user,
+// creating it if necessary.
+func OpenQueue(username string) (*Queue, error) {
+	u, err := user.Lookup(username)
+	if err != nil {
+		return nil, fmt.Errorf("lookup user: %w", err)
+	}
+	dir := path.Join(UserDataDir(u), "queue")
+	for _, sub := range []string{"dead", "msg"} {
+		if err := os.MkdirAll(path.Join(dir, sub), 0o700); err != nil {
+			return nil, err
+		}
+	}
+	return &Queue{dir}, nil
+}
+
+// Enqueue adds a delivery of activity to inbox to the queue.
+// msg is the mail message the activity was created from, if any.
+// Enqueuing the same activity for the same inbox more than once
+// results in only one pending delivery.
+func (q *Queue) Enqueue(inbox string, activity *apub.Activity, msg []byte) (*QueueItem, error) {
+	b, err := json.Marshal(activity)
+	if err != nil {
+		return nil, fmt.Errorf("encode activity: %w", err)
+	}
+	sum := sha256.Sum256([]byte(activity.ID + " " + inbox))
+	now := time.Now()
+	item := &QueueItem{
+		Inbox:    inbox,
+		Activity: b,
+		Created:  now,
+		Next:     now,
+		name:     hex.EncodeToString(sum[:16]),
+	}
+	if msg != nil {
+		if item.Message, err = q.storeMessage(msg); err != nil {
+			return nil, fmt.Errorf("store message: %w", err)
+		}
+	}
+	return item, q.write(item)
+}
+
+// storeMessage stores msg, returning its name.
+// Messages are named by their content, so enqueuing a message
+// for many inboxes stores it only once.
+func (q *Queue) storeMessage(msg []byte) (string, error) {
+	sum := sha256.Sum256(msg)
+	name := hex.EncodeToString(sum[:16])
+	dir := path.Join(q.dir, "msg")
+	if _, err := os.Stat(path.Join(dir, name)); err == nil {
+		return name, nil
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", err
+	}
+	tmp := path.Join(dir, "."+name+".tmp")
+	if err := os.WriteFile(tmp, msg, 0o600); err != nil {
+		return "", err
+	}
+	return name, os.Rename(tmp, path.Join(dir, name))
+}
+
+// Message returns the mail message from which the activity of item
+// was created, or nil if there is none.
+func (q *Queue) Message(item *QueueItem) ([]byte, error) {
+	if item.Message == "" {
+		return nil, nil
+	}
+	return os.ReadFile(path.Join(q.dir, "msg", path.Base(item.Message)))
+}
+
+// releaseMessage removes the message of item, which has left the queue,
+// unless other items in the queue or dead letters still refer to it.
+func (q *Queue) releaseMessage(item *QueueItem) error {
+	if item.Message == "" {
+		return nil
+	}
+	for _, dir := range []string{q.dir, path.Join(q.dir, "dead")} {
+		dirents, err := os.ReadDir(dir)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		for _, d := range dirents {
+			if d.IsDir() || strings.HasPrefix(d.Name(), ".") {
+				continue
+			}
+			b, err := os.ReadFile(path.Join(dir, d.Name()))
+			if err != nil {
+				continue // delivered in the meantime
+			}
+			var other QueueItem
+			if json.Unmarshal(b, &other) == nil && other.Message == item.Message {
+				return nil
+			}
+		}
+	}
+	err := os.Remove(path.Join(q.dir, "msg", path.Base(item.Message)))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// Items returns all items in the queue, including those not yet due.
+// Items being delivered by another worker are excluded.
+func (q *Queue) Items() ([]*QueueItem, error) {
+	dirents, err := os.ReadDir(q.dir)
+	if err != nil {
+		return nil, err
+	}
+	var items []*QueueItem
+	for _, d := range dirents {
+		name := d.Name()
+		if d.IsDir() || strings.HasPrefix(name, ".") {
+			continue
+		}
+		if strings.HasSuffix(name, ".work") {
+			info, err := d.Info()
+			if err == nil && time.Since(info.ModTime()) > staleClaim {
+				os.Rename(path.Join(q.dir, name), path.Join(q.dir, strings.TrimSuffix(name, ".work")))
+			}
+			continue
+		}
+		item, err := q.read(name)
+		if errors.Is(err, os.ErrNotExist) {
+			continue // claimed by someone else in the meantime
+		} else if err != nil {
+			return items, fmt.Errorf("read queue item %s: %w", name, err)
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// Deliver attempts delivery of item using client.
+// On success the item is removed from the queue.
+// On failure, the next attempt is scheduled with exponential backoff,
+// or later if the server asked us to wait.
+// If the failure is permanent, or the item has been in the queue
+// longer than QueueLifetime, the item is moved to the dead directory
+// and the returned error is an *UndeliverableError.
+func (q *Queue) Deliver(ctx context.Context, client *apub.Client, item *QueueItem) error {
+	if err := q.Claim(item); err != nil {
+		return err
+	}
+	var activity apub.Activity
+	if err := json.Unmarshal(item.Activity, &activity); err != nil {
+		os.Rename(q.claimed(item), path.Join(q.dir, "dead", item.name))
+		return &UndeliverableError{Err: fmt.Errorf("decode activity: %w", err)}
+	}
+	_, err := client.SendContext(ctx, item.Inbox, &activity)
+	return q.Done(item, err)
+}
+
+// Claim marks item as being delivered so that concurrent workers
+// don't also deliver it. Callers delivering items themselves,
+// rather than with Deliver, must call Done with the result.
+func (q *Queue) Claim(item *QueueItem) error {
+	claimed := q.claimed(item)
+	if err := os.Rename(path.Join(q.dir, item.name), claimed); err != nil {
+		return fmt.Errorf("claim queue item: %w", err)
+	}
+	// Renaming keeps the modification time of the queued file,
+	// which may be long past; claims are judged stale from when they were made.
+	now := time.Now()
+	if err := os.Chtimes(claimed, now, now); err != nil {
+		return fmt.Errorf("claim queue item: %w", err)
+	}
+	return nil
+}
+
+// Done releases the claimed item given the result of delivering it
+// as described in Deliver, returning err or an *UndeliverableError.
+func (q *Queue) Done(item *QueueItem, err error) error {
+	claimed := q.claimed(item)
+	if err == nil {
+		if err := os.Remove(claimed); err != nil {
+			return err
+		}
+		return q.releaseMessage(item)
+	}
+	item.Attempts++
+	item.Err = err.Error()
+	var serr *apub.StatusError
+	temporary := true
+	backoff := minBackoff << (item.Attempts - 1)
+	if backoff > maxBackoff || backoff <= 0 {
+		backoff = maxBackoff
+	}
+	if errors.As(err, &serr) {
+		temporary = serr.Temporary()
+		if serr.RetryAfter > backoff {
+			backoff = serr.RetryAfter
+		}
+	}
+	item.Next = time.Now().Add(backoff)
+
+	expired := item.Next.After(item.Created.Add(QueueLifetime))
+	if !temporary || expired {
+		if werr := writeItem(path.Join(q.dir, "dead", item.name), item); werr != nil {
+			return fmt.Errorf("move to dead letters: %w", werr)
+		}
+		os.Remove(claimed)
+		return &UndeliverableError{Err: err, Expired: temporary && expired}
+	}
+	if werr := q.write(item); werr != nil {
+		return fmt.Errorf("requeue: %w", werr)
+	}
+	os.Remove(claimed)
+	return err
+}
+
+func (q *Queue) claimed(item *QueueItem) string {
+	return path.Join(q.dir, item.name+".work")
+}
+
+// Run attempts delivery of all items in the queue which are due.
+// Errors from individual deliveries are passed to the function fail.
+func (q *Queue) Run(ctx context.Context, client *apub.Client, fail func(item *QueueItem, err error)) error {
+	items, err := q.Items()
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		if time.Now().Before(item.Next) {
+			continue
+		}
+		if err := q.Deliver(ctx, client, item); err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue // someone else got to it first
+			}
+			fail(item, err)
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (q *Queue) read(name string) (*QueueItem, error) {
+	b, err := os.ReadFile(path.Join(q.dir, name))
+	if err != nil {
+		return nil, err
+	}
+	item := &QueueItem{name: name}
+	if err := json.Unmarshal(b, item); err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+// write atomically writes item to the queue.
+func (q *Queue) write(item *QueueItem) error {
+	return writeItem(path.Join(q.dir, item.name), item)
+}
+
+func writeItem(name string, item *QueueItem) error {
+	b, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	tmp := path.Join(path.Dir(name), "."+path.Base(name)+".tmp")
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
@@ -0,0 +1,169 @@
+package sys
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"olowe.co/apub"
+)
+
+func TestQueue(t *testing.T) {
+	var status int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if status == http.StatusServiceUnavailable {
+			w.Header().Set("Retry-After", "3600")
+		}
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+	client := &apub.Client{Client: srv.Client()}
+
+	dir := t.TempDir()
+	if err := os.Mkdir(path.Join(dir, "dead"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	q := &Queue{dir}
+	activity := &apub.Activity{ID: "https://example.invalid/1", Type: "Create"}
+	item, err := q.Enqueue(srv.URL+"/inbox", activity, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status = http.StatusServiceUnavailable
+	if err := q.Deliver(context.Background(), client, item); err == nil {
+		t.Fatal("no error delivering to unavailable server")
+	} else if errors.Is(err, ErrUndeliverable) {
+		t.Fatalf("temporary error treated as permanent: %v", err)
+	}
+	items, err := q.Items()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 {
+		t.Fatalf("want 1 queued item, got %d", len(items))
+	}
+	if time.Until(items[0].Next) < 59*time.Minute {
+		t.Errorf("retry scheduled at %s, ignoring Retry-After", items[0].Next)
+	}
+
+	status = http.StatusGone
+	if err := q.Deliver(context.Background(), client, items[0]); !errors.Is(err, ErrUndeliverable) {
+		t.Errorf("want undeliverable error on permanent failure, got %v", err)
+	}
+	items, err = q.Items()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 0 {
+		t.Errorf("want empty queue after permanent failure, got %d items", len(items))
+	}
+	if _, err := os.Stat(path.Join(dir, "dead", item.name)); err != nil {
+		t.Errorf("undeliverable item not moved to dead letters: %v", err)
+	}
+}
+
+func TestStaleClaim(t *testing.T) {
+	dir := t.TempDir()
+	q := &Queue{dir}
+	activity := &apub.Activity{ID: "https://example.invalid/1", Type: "Create"}
+	item, err := q.Enqueue("https://example.invalid/inbox", activity, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// queued long ago, but only just claimed.
+	old := time.Now().Add(-2 * staleClaim)
+	if err := os.Chtimes(path.Join(dir, item.name), old, old); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Claim(item); err != nil {
+		t.Fatal(err)
+	}
+	// stale claims are released on one pass, then read on the next.
+	var items []*QueueItem
+	for i := 0; i < 2; i++ {
+		if items, err = q.Items(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(items) != 0 {
+		t.Fatalf("fresh claim of old item treated as stale")
+	}
+
+	// now the worker has died.
+	if err := os.Chtimes(q.claimed(item), old, old); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.Items(); err != nil {
+		t.Fatal(err)
+	}
+	items, err = q.Items()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 {
+		t.Errorf("stale claim not released")
+	}
+}
+
+func TestQueueMessage(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+	client := &apub.Client{Client: srv.Client()}
+
+	dir := t.TempDir()
+	q := &Queue{dir}
+	msg := []byte("Subject: hello\r\n\r\nhello, world\r\n")
+	activity := &apub.Activity{ID: "https://example.invalid/1", Type: "Create"}
+	var items []*QueueItem
+	for _, inbox := range []string{srv.URL + "/a/inbox", srv.URL + "/b/inbox"} {
+		item, err := q.Enqueue(inbox, activity, msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		items = append(items, item)
+	}
+	stored, err := os.ReadDir(path.Join(dir, "msg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != 1 {
+		t.Errorf("want message stored once, got %d copies", len(stored))
+	}
+	b, err := os.ReadFile(path.Join(dir, items[0].name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(b, []byte("hello, world")) || bytes.Contains(b, []byte(base64.StdEncoding.EncodeToString(msg))) {
+		t.Errorf("queue item embeds message: %s", b)
+	}
+	got, err := q.Message(items[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Errorf("got message %q, want %q", got, msg)
+	}
+
+	if err := q.Deliver(context.Background(), client, items[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.Message(items[1]); err != nil {
+		t.Errorf("message removed while still queued: %v", err)
+	}
+	if err := q.Deliver(context.Background(), client, items[1]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.Message(items[1]); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("message kept after all deliveries: %v", err)
+	}
+}
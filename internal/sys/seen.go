@@ -0,0 +1,141 @@
+package sys
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path"
+	"strings"
+)
+
+// SeenLimit is the number of IDs kept in a SeenIndex.
+const SeenLimit = 4096
+
+// SeenIndex is a bounded record of the IDs of activities and objects
+// recently received by a user, stored in a file one ID per line.
+// Once the file holds twice SeenLimit IDs,
+// it is trimmed to the most recent SeenLimit.
+type SeenIndex struct {
+	name string
+}
+
+// OpenSeen opens the index of IDs seen by the named user.
+func OpenSeen(username string) (*SeenIndex, error) {
+	u, err := user.Lookup(username)
+	if err != nil {
+		return nil, fmt.Errorf("lookup user: %w", err)
+	}
+	return OpenSeenFile(path.Join(UserDataDir(u), "seen")), nil
+}
+
+// OpenSeenFile opens the index stored in the named file.
+func OpenSeenFile(name string) *SeenIndex {
+	return &SeenIndex{name}
+}
+
+// Add records ids as seen.
+// It reports whether any of ids had already been seen.
+// Empty IDs are ignored.
+func (s *SeenIndex) Add(ids ...string) (seen bool, err error) {
+	unlock, err := lock(s.name)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+	known, err := s.read()
+	if err != nil {
+		return false, err
+	}
+	index := make(map[string]bool, len(known))
+	for _, id := range known {
+		index[id] = true
+	}
+	var added []string
+	for _, id := range ids {
+		if id == "" {
+			continue
+		}
+		if index[id] {
+			seen = true
+			continue
+		}
+		index[id] = true
+		added = append(added, id)
+	}
+	if len(added) == 0 {
+		return seen, nil
+	}
+	if len(known)+len(added) >= 2*SeenLimit {
+		return seen, s.write(append(known, added...))
+	}
+	f, err := os.OpenFile(s.name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return seen, err
+	}
+	if _, err := fmt.Fprintln(f, strings.Join(added, "\n")); err != nil {
+		f.Close()
+		return seen, err
+	}
+	return seen, f.Close()
+}
+
+// Remove removes ids from the index,
+// such as when an activity could not be handled
+// and must be accepted again when retried.
+func (s *SeenIndex) Remove(ids ...string) error {
+	unlock, err := lock(s.name)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	known, err := s.read()
+	if err != nil {
+		return err
+	}
+	remove := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		remove[id] = true
+	}
+	kept := known[:0]
+	for _, id := range known {
+		if !remove[id] {
+			kept = append(kept, id)
+		}
+	}
+	if len(kept) == len(known) {
+		return nil
+	}
+	return s.write(kept)
+}
+
+func (s *SeenIndex) read() ([]string, error) {
+	f, err := os.Open(s.name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var ids []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if line := strings.TrimSpace(sc.Text()); line != "" {
+			ids = append(ids, line)
+		}
+	}
+	return ids, sc.Err()
+}
+
+// write replaces the index with the most recent SeenLimit of ids.
+func (s *SeenIndex) write(ids []string) error {
+	if len(ids) > SeenLimit {
+		ids = ids[len(ids)-SeenLimit:]
+	}
+	tmp := path.Join(path.Dir(s.name), "."+path.Base(s.name)+".tmp")
+	if err := os.WriteFile(tmp, []byte(strings.Join(ids, "\n")+"\n"), 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.name)
+}
@@ -0,0 +1,55 @@
+package sys
+
+import (
+	"fmt"
+	"path"
+	"testing"
+)
+
+func TestSeenIndex(t *testing.T) {
+	seen := &SeenIndex{path.Join(t.TempDir(), "seen")}
+	create := "https://example.com/note/1/create"
+	note := "https://example.com/note/1"
+	if dup, err := seen.Add(create, note); dup || err != nil {
+		t.Fatalf("first add: got %v, %v", dup, err)
+	}
+	// an Announce of the same note from someone else.
+	if dup, err := seen.Add("https://example.net/announce/1", note); !dup || err != nil {
+		t.Fatalf("announce of seen note: got %v, %v", dup, err)
+	}
+	if dup, _ := seen.Add("https://example.net/announce/1"); !dup {
+		t.Errorf("announce not recorded as seen")
+	}
+	// a failed delivery is forgotten so it can be retried.
+	if err := seen.Remove(create, note); err != nil {
+		t.Fatal(err)
+	}
+	if dup, err := seen.Add(create, note); dup || err != nil {
+		t.Fatalf("add after remove: got %v, %v", dup, err)
+	}
+
+	var batch []string
+	for i := 0; i < 2*SeenLimit; i++ {
+		batch = append(batch, fmt.Sprintf("https://example.com/%d", i))
+		if len(batch) == 100 || i == 2*SeenLimit-1 {
+			if _, err := seen.Add(batch...); err != nil {
+				t.Fatal(err)
+			}
+			batch = nil
+		}
+	}
+	ids, err := seen.read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) >= 2*SeenLimit {
+		t.Errorf("index not trimmed: %d ids", len(ids))
+	}
+	if dup, _ := seen.Add(note); dup {
+		t.Errorf("old id %s still in index", note)
+	}
+	last := fmt.Sprintf("https://example.com/%d", 2*SeenLimit-1)
+	if dup, _ := seen.Add(last); !dup {
+		t.Errorf("recent id %s not in index", last)
+	}
+}
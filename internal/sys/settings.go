@@ -0,0 +1,68 @@
+package sys
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path"
+	"strings"
+)
+
+// Settings are a user's preferences.
+// They are read from the file "settings" in the user's config directory,
+// where each line is a keyword enabling a setting.
+// Blank lines and lines beginning with '#' are ignored.
+type Settings struct {
+	// ManualFollow, set by the keyword "manualfollow",
+	// holds follow requests for the user's approval instead of
+	// accepting them automatically.
+	ManualFollow bool
+	// HideFollows, set by the keyword "hidefollows",
+	// hides the members of the user's followers and following
+	// collections. Only the number of members is shown.
+	HideFollows bool
+	// Notify, set by the keyword "notify", delivers Likes, Dislikes
+	// and Announces of the user's posts as short notification messages.
+	Notify bool
+}
+
+// LoadSettings returns the settings of the named user.
+// If the user has no settings file, the zero Settings are returned.
+func LoadSettings(username string) (*Settings, error) {
+	u, err := user.Lookup(username)
+	if err != nil {
+		return nil, fmt.Errorf("lookup user: %w", err)
+	}
+	cdir, err := ConfigDir(u)
+	if err != nil {
+		return nil, fmt.Errorf("find config dir: %w", err)
+	}
+	f, err := os.Open(path.Join(cdir, "settings"))
+	if errors.Is(err, os.ErrNotExist) {
+		return &Settings{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var settings Settings
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		switch line {
+		case "manualfollow":
+			settings.ManualFollow = true
+		case "hidefollows":
+			settings.HideFollows = true
+		case "notify":
+			settings.Notify = true
+		default:
+			return nil, fmt.Errorf("unknown setting %q", line)
+		}
+	}
+	return &settings, sc.Err()
+}
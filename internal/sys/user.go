@@ -1,16 +1,20 @@
 package sys
 
 import (
+	"crypto"
+	"crypto/ed25519"
 	"crypto/rsa"
-	"crypto/x509"
 	"encoding/json"
-	"encoding/pem"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
 	"os"
 	"os/user"
 	"path"
+	"sort"
+	"strings"
+	"time"
 
 	"olowe.co/apub"
 	"webfinger.net/go/webfinger"
@@ -54,6 +58,28 @@ func Actor(name, host string) (*apub.Actor, error) {
 	if err != nil {
 		return nil, fmt.Errorf("read public key file: %w", err)
 	}
+	key, err := apub.ParsePublicKey(pubkey)
+	if err != nil {
+		return nil, fmt.Errorf("parse public key: %w", err)
+	}
+	// publicKey is all most servers understand, and they only understand RSA.
+	if _, ok := key.(*rsa.PublicKey); !ok {
+		return nil, fmt.Errorf("public key is %T, not RSA", key)
+	}
+	// A user may also have an Ed25519 key to sign requests using RFC 9421,
+	// published as a Multikey (FEP-521a) for servers to verify them.
+	var methods []apub.Multikey
+	edkey, err := loadEd25519Key(cdir)
+	if err != nil {
+		return nil, fmt.Errorf("load ed25519 key: %w", err)
+	}
+	if edkey != nil {
+		mkey, err := apub.NewMultikey(root+"/actor.json"+ed25519KeyFragment, root+"/actor.json", edkey.Public())
+		if err != nil {
+			return nil, fmt.Errorf("encode ed25519 key: %w", err)
+		}
+		methods = append(methods, mkey)
+	}
 	return &apub.Actor{
 		AtContext: apub.NormContext,
 		ID:        root + "/actor.json",
@@ -62,11 +88,14 @@ func Actor(name, host string) (*apub.Actor, error) {
 		Username:  u.Username,
 		Inbox:     root + "/inbox",
 		Outbox:    root + "/outbox",
+		Followers: root + "/followers",
+		Following: root + "/following",
 		PublicKey: apub.PublicKey{
 			ID:           root + "/actor.json#main-key",
 			Owner:        root + "/actor.json",
 			PublicKeyPEM: string(pubkey),
 		},
+		AssertionMethod: methods,
 	}, nil
 }
 
@@ -88,20 +117,52 @@ func ClientFor(username, host string) (*apub.Client, error) {
 	if err != nil {
 		return nil, fmt.Errorf("load private key: %w", err)
 	}
-	return &apub.Client{
+	client := &apub.Client{
 		Client:   http.DefaultClient,
 		Key:      key,
 		PubKeyID: actor.PublicKey.ID,
-	}, nil
+	}
+	edkey, err := loadEd25519Key(cdir)
+	if err != nil {
+		return nil, fmt.Errorf("load ed25519 key: %w", err)
+	}
+	if edkey != nil {
+		client.RFC9421Key = edkey
+		client.RFC9421KeyID = actor.ID + ed25519KeyFragment
+	}
+	return client, nil
+}
+
+// ed25519KeyFile is the name of the file in a user's config directory
+// holding their optional Ed25519 private key, in PKCS #8 PEM format.
+// Its public key is published with the ID fragment ed25519KeyFragment.
+const (
+	ed25519KeyFile     = "ed25519.pem"
+	ed25519KeyFragment = "#ed25519-key"
+)
+
+// loadEd25519Key returns the Ed25519 key in the config directory cdir,
+// or nil if there is none.
+func loadEd25519Key(cdir string) (ed25519.PrivateKey, error) {
+	key, err := loadKey(path.Join(cdir, ed25519KeyFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	edkey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s holds %T, not an ed25519 key", ed25519KeyFile, key)
+	}
+	return edkey, nil
 }
 
-func loadKey(name string) (*rsa.PrivateKey, error) {
+func loadKey(name string) (crypto.Signer, error) {
 	b, err := os.ReadFile(name)
 	if err != nil {
 		return nil, err
 	}
-	block, _ := pem.Decode(b)
-	return x509.ParsePKCS1PrivateKey(block.Bytes)
+	return apub.ParsePrivateKey(b)
 }
 
 func JRDFor(username, domain string) (*webfinger.JRD, error) {
@@ -140,3 +201,124 @@ func AppendToOutbox(username string, activities ...*apub.Activity) error {
 	}
 	return nil
 }
+
+// OutboxObject returns the object or activity with the given ID
+// from the named user's outbox.
+// If there is no such object, the error wraps os.ErrNotExist.
+func OutboxObject(username, id string) (*apub.Activity, error) {
+	u, err := user.Lookup(username)
+	if err != nil {
+		return nil, fmt.Errorf("lookup user: %w", err)
+	}
+	f, err := os.Open(path.Join(UserDataDir(u), "outbox", path.Base(id)))
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", id, err)
+	}
+	defer f.Close()
+	obj, err := apub.Decode(f)
+	if err != nil {
+		return nil, err
+	}
+	if obj.ID != id {
+		return nil, fmt.Errorf("%s not in outbox: %w", id, os.ErrNotExist)
+	}
+	return obj, nil
+}
+
+// TombstoneOutbox replaces the object deleted by del in the named user's outbox
+// with a Tombstone, and removes the Create activity wrapping it.
+func TombstoneOutbox(username string, del *apub.Activity) error {
+	u, err := user.Lookup(username)
+	if err != nil {
+		return fmt.Errorf("lookup user: %w", err)
+	}
+	id := del.ObjectID()
+	if id == "" {
+		return fmt.Errorf("no object in %s", del.ID)
+	}
+	obj, err := OutboxObject(username, id)
+	if err != nil {
+		return err
+	}
+	name := path.Join(UserDataDir(u), "outbox", path.Base(id))
+	if obj.Type == "Tombstone" {
+		return nil
+	}
+	now := time.Now()
+	if del.Published != nil {
+		now = *del.Published
+	}
+	tomb := &apub.Activity{
+		AtContext:  apub.NormContext,
+		ID:         obj.ID,
+		Type:       "Tombstone",
+		FormerType: obj.Type,
+		Published:  obj.Published,
+		Deleted:    &now,
+	}
+	b, err := json.Marshal(tomb)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(name, b, 0644); err != nil {
+		return err
+	}
+	err = os.Remove(name + "-create")
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// Outbox returns the activities in the named user's outbox
+// of the given types, most recently published first.
+// If no types are given, all activities are returned.
+func Outbox(username string, types ...string) ([]*apub.Activity, error) {
+	u, err := user.Lookup(username)
+	if err != nil {
+		return nil, fmt.Errorf("lookup user: %w", err)
+	}
+	outbox := path.Join(UserDataDir(u), "outbox")
+	dirents, err := os.ReadDir(outbox)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var activities []*apub.Activity
+	for _, d := range dirents {
+		if d.IsDir() || strings.HasPrefix(d.Name(), ".") {
+			continue
+		}
+		f, err := os.Open(path.Join(outbox, d.Name()))
+		if err != nil {
+			return nil, err
+		}
+		a, err := apub.Decode(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", d.Name(), err)
+		}
+		if len(types) > 0 && !contains(types, a.Type) {
+			continue
+		}
+		activities = append(activities, a)
+	}
+	sort.SliceStable(activities, func(i, j int) bool {
+		pi, pj := activities[i].Published, activities[j].Published
+		if pi == nil || pj == nil {
+			return pj == nil && pi != nil
+		}
+		return pi.After(*pj)
+	})
+	return activities, nil
+}
+
+func contains(ss []string, s string) bool {
+	for i := range ss {
+		if ss[i] == s {
+			return true
+		}
+	}
+	return false
+}
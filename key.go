@@ -0,0 +1,270 @@
+package apub
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Multikey represents a public key using the Multikey data model
+// from the Controlled Identifiers specification.
+// Actors list them in their assertionMethod property.
+// See FEP-521a.
+type Multikey struct {
+	ID                 string `json:"id"`
+	Type               string `json:"type"`
+	Controller         string `json:"controller"`
+	PublicKeyMultibase string `json:"publicKeyMultibase"`
+}
+
+// NewMultikey returns a Multikey of pub identified by id
+// and controlled by the Actor with ID controller.
+func NewMultikey(id, controller string, pub crypto.PublicKey) (Multikey, error) {
+	enc, err := EncodeMultibase(pub)
+	if err != nil {
+		return Multikey{}, err
+	}
+	return Multikey{
+		ID:                 id,
+		Type:               "Multikey",
+		Controller:         controller,
+		PublicKeyMultibase: enc,
+	}, nil
+}
+
+// Key returns the public key identified by id published by the Actor,
+// either in its publicKey or assertionMethod properties.
+// The key must be served from the same origin as the Actor,
+// otherwise any server could publish keys for Actors it does not host.
+func (a *Actor) Key(id string) (crypto.PublicKey, error) {
+	if !sameOrigin(id, a.ID) {
+		return nil, fmt.Errorf("key %s not from the same origin as %s", id, a.ID)
+	}
+	if a.PublicKey.ID == id {
+		if a.PublicKey.Owner != a.ID {
+			return nil, fmt.Errorf("key %s owned by %s, not %s", id, a.PublicKey.Owner, a.ID)
+		}
+		return ParsePublicKey([]byte(a.PublicKey.PublicKeyPEM))
+	}
+	for _, mk := range a.AssertionMethod {
+		if mk.ID != id {
+			continue
+		}
+		if mk.Controller != a.ID {
+			return nil, fmt.Errorf("key %s controlled by %s, not %s", id, mk.Controller, a.ID)
+		}
+		return DecodeMultibase(mk.PublicKeyMultibase)
+	}
+	return nil, fmt.Errorf("actor %s has no key %s", a.ID, id)
+}
+
+// ParsePrivateKey parses a PEM-encoded private key.
+// RSA keys in PKCS #1 form and RSA or Ed25519 keys in PKCS #8 form are supported.
+func ParsePrivateKey(b []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("no pem data")
+	}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		switch k := key.(type) {
+		case *rsa.PrivateKey:
+			return k, nil
+		case ed25519.PrivateKey:
+			return k, nil
+		}
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	return nil, fmt.Errorf("unsupported pem block type %s", block.Type)
+}
+
+// ParsePublicKey parses a PEM-encoded public key,
+// such as from the publicKeyPem property of an Actor.
+// RSA keys in PKCS #1 form and RSA or Ed25519 keys in PKIX form are supported.
+func ParsePublicKey(b []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("no pem data")
+	}
+	switch block.Type {
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	case "PUBLIC KEY":
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		switch k := key.(type) {
+		case *rsa.PublicKey:
+			return k, nil
+		case ed25519.PublicKey:
+			return k, nil
+		}
+		return nil, fmt.Errorf("unsupported public key type %T", key)
+	}
+	return nil, fmt.Errorf("unsupported pem block type %s", block.Type)
+}
+
+// Multicodec prefixes, encoded as unsigned varints, of supported key types.
+// See https://github.com/multiformats/multicodec/blob/master/table.csv
+var (
+	ed25519Codec = []byte{0xed, 0x01}
+	rsaCodec     = []byte{0x85, 0x24}
+)
+
+// EncodeMultibase returns the multibase, base58-btc encoding of pub
+// as used by the publicKeyMultibase property of a Multikey.
+func EncodeMultibase(pub crypto.PublicKey) (string, error) {
+	var b []byte
+	switch k := pub.(type) {
+	case ed25519.PublicKey:
+		b = append(append(b, ed25519Codec...), k...)
+	case *rsa.PublicKey:
+		b = append(append(b, rsaCodec...), x509.MarshalPKCS1PublicKey(k)...)
+	default:
+		return "", fmt.Errorf("unsupported public key type %T", pub)
+	}
+	return "z" + base58Encode(b), nil
+}
+
+// DecodeMultibase decodes a public key encoded by EncodeMultibase.
+func DecodeMultibase(s string) (crypto.PublicKey, error) {
+	if len(s) == 0 {
+		return nil, errors.New("empty multibase string")
+	}
+	if !strings.HasPrefix(s, "z") {
+		return nil, fmt.Errorf("unsupported multibase encoding %q", s[:1])
+	}
+	b, err := base58Decode(s[1:])
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case strings.HasPrefix(string(b), string(ed25519Codec)):
+		b = b[len(ed25519Codec):]
+		if len(b) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("bad ed25519 public key length %d", len(b))
+		}
+		return ed25519.PublicKey(b), nil
+	case strings.HasPrefix(string(b), string(rsaCodec)):
+		return x509.ParsePKCS1PublicKey(b[len(rsaCodec):])
+	}
+	return nil, errors.New("unsupported multicodec key type")
+}
+
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+func base58Encode(b []byte) string {
+	var zeros int
+	for zeros < len(b) && b[zeros] == 0 {
+		zeros++
+	}
+	// base58 digits, least significant first.
+	var digits []byte
+	for _, c := range b[zeros:] {
+		carry := int(c)
+		for i := range digits {
+			carry += int(digits[i]) << 8
+			digits[i] = byte(carry % 58)
+			carry /= 58
+		}
+		for carry > 0 {
+			digits = append(digits, byte(carry%58))
+			carry /= 58
+		}
+	}
+	buf := make([]byte, zeros+len(digits))
+	for i := 0; i < zeros; i++ {
+		buf[i] = base58Alphabet[0]
+	}
+	for i, d := range digits {
+		buf[len(buf)-1-i] = base58Alphabet[d]
+	}
+	return string(buf)
+}
+
+func base58Decode(s string) ([]byte, error) {
+	var zeros int
+	for zeros < len(s) && s[zeros] == base58Alphabet[0] {
+		zeros++
+	}
+	// bytes, least significant first.
+	var b []byte
+	for _, r := range s[zeros:] {
+		carry := strings.IndexRune(base58Alphabet, r)
+		if carry < 0 {
+			return nil, fmt.Errorf("invalid base58 character %q", r)
+		}
+		for i := range b {
+			carry += int(b[i]) * 58
+			b[i] = byte(carry)
+			carry >>= 8
+		}
+		for carry > 0 {
+			b = append(b, byte(carry))
+			carry >>= 8
+		}
+	}
+	buf := make([]byte, zeros+len(b))
+	for i, c := range b {
+		buf[len(buf)-1-i] = c
+	}
+	return buf, nil
+}
+
+// signMessage signs msg with key.
+// RSA keys sign a SHA-256 digest of msg using PKCS #1 v1.5;
+// Ed25519 keys sign msg directly.
+func signMessage(key crypto.Signer, msg []byte) ([]byte, error) {
+	switch key.Public().(type) {
+	case *rsa.PublicKey:
+		hash := sha256.Sum256(msg)
+		return key.Sign(rand.Reader, hash[:], crypto.SHA256)
+	case ed25519.PublicKey:
+		return key.Sign(rand.Reader, msg, crypto.Hash(0))
+	}
+	return nil, fmt.Errorf("unsupported key type %T", key.Public())
+}
+
+// verifyMessage reports whether sig is a valid signature of msg by pub.
+// See signMessage.
+func verifyMessage(pub crypto.PublicKey, msg, sig []byte) error {
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		hash := sha256.Sum256(msg)
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, hash[:], sig)
+	case ed25519.PublicKey:
+		if !ed25519.Verify(k, msg, sig) {
+			return errors.New("ed25519 verification failed")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported key type %T", pub)
+}
+
+// sameOrigin reports whether the URLs a and b have the same scheme and host.
+func sameOrigin(a, b string) bool {
+	ua, err := url.Parse(a)
+	if err != nil {
+		return false
+	}
+	ub, err := url.Parse(b)
+	if err != nil {
+		return false
+	}
+	return ua.Scheme == ub.Scheme && ua.Host != "" && ua.Host == ub.Host
+}
@@ -0,0 +1,96 @@
+package apub
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMultibase(t *testing.T) {
+	rsakey, err := readPubKey("testdata/public.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	edkey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		key    interface{}
+		prefix string
+	}{
+		{rsakey, "z4MX"},
+		{edkey, "z6Mk"},
+	}
+	for _, tt := range tests {
+		enc, err := EncodeMultibase(tt.key)
+		if err != nil {
+			t.Errorf("encode %T: %v", tt.key, err)
+			continue
+		}
+		if !strings.HasPrefix(enc, tt.prefix) {
+			t.Errorf("encoded %T should start with %s, got %s", tt.key, tt.prefix, enc)
+		}
+		got, err := DecodeMultibase(enc)
+		if err != nil {
+			t.Errorf("decode %s: %v", enc, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.key) {
+			t.Errorf("decoded %T differs from original", tt.key)
+		}
+	}
+	for _, bad := range []string{"", "z", "m7QEg"} {
+		if _, err := DecodeMultibase(bad); err == nil {
+			t.Errorf("decoded bad multibase %q", bad)
+		}
+	}
+}
+
+func TestParseKeys(t *testing.T) {
+	b, err := os.ReadFile("testdata/private.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParsePrivateKey(b); err != nil {
+		t.Errorf("parse private key: %v", err)
+	}
+	b, err = os.ReadFile("testdata/public.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParsePublicKey(b); err != nil {
+		t.Errorf("parse public key: %v", err)
+	}
+}
+
+func TestEd25519(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	actor := &Actor{ID: "https://from.invalid/actor"}
+	mkey, err := NewMultikey(actor.ID+"#ed25519-key", actor.ID, pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	actor.AssertionMethod = []Multikey{mkey}
+
+	for _, sign := range []func(*http.Request, crypto.Signer, string) error{Sign, SignRFC9421} {
+		req, err := http.NewRequest(http.MethodPost, "https://example.invalid/inbox", strings.NewReader("hello, world!"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sign(req, priv, mkey.ID); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Verify(req, actor.Key); err != nil {
+			t.Errorf("verify: %v", err)
+		}
+	}
+}
@@ -1,12 +1,18 @@
 package lemmy
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
 )
 
 func (c *Client) Login(name, password string) error {
+	return c.LoginContext(context.Background(), name, password)
+}
+
+// LoginContext is like Login but uses ctx for the underlying HTTP requests.
+func (c *Client) LoginContext(ctx context.Context, name, password string) error {
 	if !c.ready {
 		if err := c.init(); err != nil {
 			return err
@@ -17,7 +23,7 @@ func (c *Client) Login(name, password string) error {
 		"username_or_email": name,
 		"password":          password,
 	}
-	resp, err := c.post("/user/login", params)
+	resp, err := c.post(ctx, "/user/login", params)
 	if err != nil {
 		return err
 	}
@@ -2,6 +2,7 @@ package lemmy
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -62,6 +63,11 @@ func (c *Client) init() error {
 }
 
 func (c *Client) Communities(mode ListMode) ([]Community, error) {
+	return c.CommunitiesContext(context.Background(), mode)
+}
+
+// CommunitiesContext is like Communities but uses ctx for the underlying HTTP requests.
+func (c *Client) CommunitiesContext(ctx context.Context, mode ListMode) ([]Community, error) {
 	if !c.ready {
 		if err := c.init(); err != nil {
 			return nil, err
@@ -79,7 +85,7 @@ func (c *Client) Communities(mode ListMode) ([]Community, error) {
 		}
 		params["auth"] = c.authToken
 	}
-	resp, err := c.get("community/list", params)
+	resp, err := c.get(ctx, "community/list", params)
 	if err != nil {
 		return nil, err
 	}
@@ -104,6 +110,11 @@ func (c *Client) Communities(mode ListMode) ([]Community, error) {
 }
 
 func (c *Client) LookupCommunity(name string) (Community, Counts, error) {
+	return c.LookupCommunityContext(context.Background(), name)
+}
+
+// LookupCommunityContext is like LookupCommunity but uses ctx for the underlying HTTP requests.
+func (c *Client) LookupCommunityContext(ctx context.Context, name string) (Community, Counts, error) {
 	if !c.ready {
 		if err := c.init(); err != nil {
 			return Community{}, Counts{}, err
@@ -117,7 +128,7 @@ func (c *Client) LookupCommunity(name string) (Community, Counts, error) {
 	}
 
 	params := map[string]string{"name": name}
-	resp, err := c.get("community", params)
+	resp, err := c.get(ctx, "community", params)
 	if err != nil {
 		return Community{}, Counts{}, err
 	}
@@ -151,6 +162,11 @@ func (c *Client) LookupCommunity(name string) (Community, Counts, error) {
 }
 
 func (c *Client) Posts(community string, mode ListMode) ([]Post, error) {
+	return c.PostsContext(context.Background(), community, mode)
+}
+
+// PostsContext is like Posts but uses ctx for the underlying HTTP requests.
+func (c *Client) PostsContext(ctx context.Context, community string, mode ListMode) ([]Post, error) {
 	if !c.ready {
 		if err := c.init(); err != nil {
 			return nil, err
@@ -163,7 +179,7 @@ func (c *Client) Posts(community string, mode ListMode) ([]Post, error) {
 		"type_": string(mode),
 		"sort":  "New",
 	}
-	resp, err := c.get("post/list", params)
+	resp, err := c.get(ctx, "post/list", params)
 	if err != nil {
 		return nil, err
 	}
@@ -198,6 +214,11 @@ func (c *Client) Posts(community string, mode ListMode) ([]Post, error) {
 }
 
 func (c *Client) LookupPost(id int) (Post, error) {
+	return c.LookupPostContext(context.Background(), id)
+}
+
+// LookupPostContext is like LookupPost but uses ctx for the underlying HTTP requests.
+func (c *Client) LookupPostContext(ctx context.Context, id int) (Post, error) {
 	if !c.ready {
 		if err := c.init(); err != nil {
 			return Post{}, err
@@ -211,7 +232,7 @@ func (c *Client) LookupPost(id int) (Post, error) {
 	}
 
 	params := map[string]string{"id": strconv.Itoa(id)}
-	resp, err := c.get("post", params)
+	resp, err := c.get(ctx, "post", params)
 	if err != nil {
 		return Post{}, err
 	}
@@ -234,6 +255,11 @@ func (c *Client) LookupPost(id int) (Post, error) {
 }
 
 func (c *Client) Comments(post int, mode ListMode) ([]Comment, error) {
+	return c.CommentsContext(context.Background(), post, mode)
+}
+
+// CommentsContext is like Comments but uses ctx for the underlying HTTP requests.
+func (c *Client) CommentsContext(ctx context.Context, post int, mode ListMode) ([]Comment, error) {
 	if !c.ready {
 		if err := c.init(); err != nil {
 			return nil, err
@@ -246,7 +272,7 @@ func (c *Client) Comments(post int, mode ListMode) ([]Comment, error) {
 		"limit":   "30",
 		"sort":    "New",
 	}
-	resp, err := c.get("comment/list", params)
+	resp, err := c.get(ctx, "comment/list", params)
 	if err != nil {
 		return nil, err
 	}
@@ -273,6 +299,11 @@ func (c *Client) Comments(post int, mode ListMode) ([]Comment, error) {
 }
 
 func (c *Client) LookupComment(id int) (Comment, error) {
+	return c.LookupCommentContext(context.Background(), id)
+}
+
+// LookupCommentContext is like LookupComment but uses ctx for the underlying HTTP requests.
+func (c *Client) LookupCommentContext(ctx context.Context, id int) (Comment, error) {
 	if !c.ready {
 		if err := c.init(); err != nil {
 			return Comment{}, err
@@ -280,7 +311,7 @@ func (c *Client) LookupComment(id int) (Comment, error) {
 	}
 
 	params := map[string]string{"id": strconv.Itoa(id)}
-	resp, err := c.get("comment", params)
+	resp, err := c.get(ctx, "comment", params)
 	if err != nil {
 		return Comment{}, err
 	}
@@ -302,6 +333,11 @@ func (c *Client) LookupComment(id int) (Comment, error) {
 }
 
 func (c *Client) Reply(post int, parent int, msg string) error {
+	return c.ReplyContext(context.Background(), post, parent, msg)
+}
+
+// ReplyContext is like Reply but uses ctx for the underlying HTTP requests.
+func (c *Client) ReplyContext(ctx context.Context, post int, parent int, msg string) error {
 	if c.authToken == "" {
 		return errors.New("not logged in")
 	}
@@ -314,7 +350,7 @@ func (c *Client) Reply(post int, parent int, msg string) error {
 	if parent > 0 {
 		params["parent_id"] = strconv.Itoa(parent)
 	}
-	resp, err := c.post("/comment", params)
+	resp, err := c.post(ctx, "/comment", params)
 	if err != nil {
 		return err
 	}
@@ -325,7 +361,7 @@ func (c *Client) Reply(post int, parent int, msg string) error {
 	return nil
 }
 
-func (c *Client) post(pathname string, params map[string]interface{}) (*http.Response, error) {
+func (c *Client) post(ctx context.Context, pathname string, params map[string]interface{}) (*http.Response, error) {
 	u := *c.instance
 	u.Path = path.Join(u.Path, pathname)
 
@@ -333,7 +369,7 @@ func (c *Client) post(pathname string, params map[string]interface{}) (*http.Res
 	if err != nil {
 		return nil, fmt.Errorf("encode body: %w", err)
 	}
-	req, err := http.NewRequest(http.MethodPost, u.String(), bytes.NewReader(b))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), bytes.NewReader(b))
 	if err != nil {
 		return nil, err
 	}
@@ -342,7 +378,7 @@ func (c *Client) post(pathname string, params map[string]interface{}) (*http.Res
 	return c.Do(req)
 }
 
-func (c *Client) get(pathname string, params map[string]string) (*http.Response, error) {
+func (c *Client) get(ctx context.Context, pathname string, params map[string]string) (*http.Response, error) {
 	u := *c.instance
 	u.Path = path.Join(u.Path, pathname)
 	vals := make(url.Values)
@@ -350,7 +386,7 @@ func (c *Client) get(pathname string, params map[string]string) (*http.Response,
 		vals.Set(k, v)
 	}
 	u.RawQuery = vals.Encode()
-	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
 	if err != nil {
 		return nil, err
 	}
@@ -363,8 +399,13 @@ func (c *Client) get(pathname string, params map[string]string) (*http.Response,
 		return resp, err
 	}
 	if resp.StatusCode == http.StatusServiceUnavailable {
-		time.Sleep(2 * time.Second)
-		resp, err = c.get(pathname, params)
+		resp.Body.Close()
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(2 * time.Second):
+		}
+		resp, err = c.get(ctx, pathname, params)
 	}
 	return resp, err
 }
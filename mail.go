@@ -2,32 +2,75 @@ package apub
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"html"
 	"io"
+	"log"
+	"mime"
+	"mime/multipart"
 	"mime/quotedprintable"
 	"net/mail"
 	"net/smtp"
+	"net/textproto"
+	"sort"
 	"strings"
 	"time"
 )
 
+// DefaultThreadDepth is the number of posts, above the one replied to,
+// looked up to list in the References header of a marshalled reply
+// unless set otherwise in MailOptions.
+const DefaultThreadDepth = 10
+
+// MailOptions holds options for marshalling activities to mail messages.
+type MailOptions struct {
+	// ThreadDepth is the number of posts, above the one replied to,
+	// looked up to list in the References header of a reply.
+	// If zero, DefaultThreadDepth is used.
+	// If negative, only the post replied to is listed.
+	ThreadDepth int
+}
+
+// MarshalMail encodes activity as a mail message.
+// The References header of a reply lists the post replied to
+// and up to DefaultThreadDepth posts above it.
 func MarshalMail(activity *Activity, client *Client) ([]byte, error) {
-	msg, err := marshalMail(activity, client)
+	return MarshalMailContext(context.Background(), activity, client, nil)
+}
+
+// MarshalMailContext is like MarshalMail but uses ctx for any
+// requests made to look up actors and posts, and the given options.
+// If opts is nil, the defaults described in MailOptions are used.
+func MarshalMailContext(ctx context.Context, activity *Activity, client *Client, opts *MailOptions) ([]byte, error) {
+	depth := DefaultThreadDepth
+	if opts != nil && opts.ThreadDepth != 0 {
+		depth = opts.ThreadDepth
+	}
+	msg, err := marshalMail(ctx, activity, client, depth)
 	if err != nil {
 		return nil, err
 	}
 	return encodeMsg(msg), nil
 }
 
-func marshalMail(activity *Activity, client *Client) (*mail.Message, error) {
+func marshalMail(ctx context.Context, activity *Activity, client *Client, depth int) (*mail.Message, error) {
 	if client == nil {
 		client = &DefaultClient
 	}
 
+	switch activity.Type {
+	case "Like", "Dislike", "Announce":
+		return marshalNotification(ctx, activity, client)
+	}
+
 	msg := new(mail.Message)
 	msg.Header = make(mail.Header)
 	var actors []Actor
-	from, err := client.LookupActor(activity.AttributedTo)
+	from, err := client.LookupActorContext(ctx, activity.AttributedTo)
 	if err != nil {
 		return nil, fmt.Errorf("build From: lookup actor %s: %w", activity.AttributedTo, err)
 	}
@@ -40,15 +83,18 @@ func marshalMail(activity *Activity, client *Client) (*mail.Message, error) {
 			continue
 		}
 
-		a, err := client.LookupActor(id)
+		a, err := client.LookupContext(ctx, id)
 		if err != nil {
-			return nil, fmt.Errorf("build To: lookup actor %s: %w", id, err)
+			return nil, fmt.Errorf("build To: lookup %s: %w", id, err)
 		}
 		if a.Type == "Collection" || a.Type == "OrderedCollection" {
 			collections = append(collections, a.ID)
+		} else if isActor(a.Type) {
+			actor := activityToActor(a)
+			addrs = append(addrs, actor.Address().String())
+			actors = append(actors, *actor)
 		} else {
-			addrs = append(addrs, a.Address().String())
-			actors = append(actors, *a)
+			return nil, fmt.Errorf("build To: %s is a %s, not an actor", id, a.Type)
 		}
 	}
 	for _, id := range collections {
@@ -64,16 +110,19 @@ func marshalMail(activity *Activity, client *Client) (*mail.Message, error) {
 			continue
 		}
 
-		a, err := client.LookupActor(id)
+		a, err := client.LookupContext(ctx, id)
 		if err != nil {
-			return nil, fmt.Errorf("build CC: lookup actor %s: %w", id, err)
+			return nil, fmt.Errorf("build CC: lookup %s: %w", id, err)
 		}
 		if a.Type == "Collection" || a.Type == "OrderedCollection" {
 			collections = append(collections, a.ID)
 			continue
+		} else if !isActor(a.Type) {
+			return nil, fmt.Errorf("build CC: %s is a %s, not an actor", id, a.Type)
 		}
-		addrs = append(addrs, a.Address().String())
-		actors = append(actors, *a)
+		actor := activityToActor(a)
+		addrs = append(addrs, actor.Address().String())
+		actors = append(actors, *actor)
 	}
 	for _, id := range collections {
 		if i := indexFollowers(actors, id); i >= 0 {
@@ -84,25 +133,184 @@ func marshalMail(activity *Activity, client *Client) (*mail.Message, error) {
 
 	msg.Header["Date"] = []string{activity.Published.Format(time.RFC1123Z)}
 	msg.Header["Message-ID"] = []string{"<" + activity.ID + ">"}
+	if activity.Updated != nil && activity.Updated.After(*activity.Published) {
+		// Each edit is a new message replacing the original.
+		msg.Header["Date"] = []string{activity.Updated.Format(time.RFC1123Z)}
+		msg.Header["Message-ID"] = []string{fmt.Sprintf("<%s#%d>", activity.ID, activity.Updated.Unix())}
+		msg.Header["Supersedes"] = []string{"<" + activity.ID + ">"}
+	}
 	msg.Header["Subject"] = []string{activity.Name}
 	if activity.Audience != "" {
 		msg.Header["List-ID"] = []string{"<" + activity.Audience + ">"}
 	}
 	if activity.InReplyTo != "" {
 		msg.Header["In-Reply-To"] = []string{"<" + activity.InReplyTo + ">"}
+		refs := client.references(ctx, activity.InReplyTo, depth)
+		for i := range refs {
+			refs[i] = "<" + refs[i] + ">"
+		}
+		msg.Header["References"] = []string{strings.Join(refs, " ")}
+	}
+	if thread := activity.Context; thread != "" || activity.Conversation != "" {
+		if thread == "" {
+			thread = activity.Conversation
+		}
+		msg.Header["Thread-Index"] = []string{threadIndex(thread)}
 	}
 
 	msg.Body = strings.NewReader(activity.Content)
-	msg.Header["Content-Type"] = []string{"text/html; charset=utf-8"}
+	msg.Header["Content-Type"] = []string{"text/plain; charset=utf-8"}
 	if activity.Source.Content != "" && activity.Source.MediaType == "text/markdown" {
 		msg.Body = strings.NewReader(activity.Source.Content)
-		msg.Header["Content-Type"] = []string{"text/plain; charset=utf-8"}
-	} else if activity.MediaType == "text/markdown" {
-		msg.Header["Content-Type"] = []string{"text/plain; charset=utf-8"}
+	} else if activity.MediaType != "text/markdown" {
+		if err := alternative(msg, activity.Content); err != nil {
+			return nil, fmt.Errorf("write html alternative: %w", err)
+		}
+	}
+	if len(activity.Attachment) > 0 {
+		if err := attachMedia(ctx, msg, activity.Attachment, client); err != nil {
+			return nil, fmt.Errorf("attach media: %w", err)
+		}
+	}
+	return msg, nil
+}
+
+// references returns the IDs of the post parent and those it replies to,
+// oldest first, as listed in the References header of a reply to parent.
+// At most depth posts above parent are looked up.
+// The thread is cut short where a post cannot be looked up.
+func (c *Client) references(ctx context.Context, parent string, depth int) []string {
+	refs := []string{parent}
+	seen := map[string]bool{parent: true}
+	for i := 0; i < depth; i++ {
+		post, err := c.LookupContext(ctx, parent)
+		if err != nil || post.InReplyTo == "" || seen[post.InReplyTo] {
+			break
+		}
+		parent = post.InReplyTo
+		seen[parent] = true
+		refs = append([]string{parent}, refs...)
+	}
+	return refs
+}
+
+// threadIndex returns a Thread-Index header value for the thread with the given ID.
+// The value is the same for every message in the thread,
+// letting clients which thread on the header group them without lookups.
+// Like Microsoft's format, it is 22 bytes encoded as base64,
+// but derived from a hash of the thread's ID.
+func threadIndex(thread string) string {
+	sum := sha256.Sum256([]byte(thread))
+	return base64.StdEncoding.EncodeToString(sum[:22])
+}
+
+// alternative sets the body of msg to a multipart/alternative body
+// of a plain text rendering of the HTML content, and the HTML itself.
+func alternative(msg *mail.Message, content string) error {
+	buf := &bytes.Buffer{}
+	w := multipart.NewWriter(buf)
+	parts := []struct {
+		typ  string
+		body string
+	}{
+		{"text/plain; charset=utf-8", htmlToText(content)},
+		{"text/html; charset=utf-8", content},
+	}
+	for _, p := range parts {
+		cte, body := transferEncode(p.typ, []byte(p.body))
+		header := make(textproto.MIMEHeader)
+		header.Set("Content-Type", p.typ)
+		if cte != "" {
+			header.Set("Content-Transfer-Encoding", cte)
+		}
+		pw, err := w.CreatePart(header)
+		if err != nil {
+			return err
+		}
+		if _, err := pw.Write(body); err != nil {
+			return err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	msg.Header["Content-Type"] = []string{mime.FormatMediaType("multipart/alternative", map[string]string{"boundary": w.Boundary()})}
+	msg.Body = buf
+	return nil
+}
+
+// marshalNotification returns a short message notifying the reader
+// of a reaction to, or boost of, a post.
+// The message is a reply to the post so that mail clients
+// show it in the same thread.
+func marshalNotification(ctx context.Context, activity *Activity, client *Client) (*mail.Message, error) {
+	from, err := client.LookupActorContext(ctx, activity.Actor)
+	if err != nil {
+		return nil, fmt.Errorf("build From: lookup actor %s: %w", activity.Actor, err)
 	}
+	id := activity.ObjectID()
+	if id == "" {
+		return nil, fmt.Errorf("no object in %s", activity.ID)
+	}
+	verb := map[string]string{
+		"Like":     "liked",
+		"Dislike":  "disliked",
+		"Announce": "boosted",
+	}[activity.Type]
+
+	// Name the post if we can, but a notification isn't worth failing over.
+	what := id
+	if obj, err := activity.UnwrapContext(ctx, client); err == nil {
+		if obj.Name != "" {
+			what = fmt.Sprintf("%q", obj.Name)
+		} else if obj.Content != "" {
+			what = fmt.Sprintf("%q", summarise(obj.Content, 40))
+		}
+	}
+	name := from.Name
+	if name == "" {
+		name = from.Username
+	}
+	date := time.Now()
+	if activity.Published != nil {
+		date = *activity.Published
+	}
+
+	msg := new(mail.Message)
+	msg.Header = make(mail.Header)
+	msg.Header["From"] = []string{from.Address().String()}
+	msg.Header["Date"] = []string{date.Format(time.RFC1123Z)}
+	msg.Header["Message-ID"] = []string{"<" + activity.ID + ">"}
+	msg.Header["In-Reply-To"] = []string{"<" + id + ">"}
+	msg.Header["References"] = []string{"<" + id + ">"}
+	msg.Header["Subject"] = []string{fmt.Sprintf("%s %s %s", name, verb, what)}
+	msg.Header["Content-Type"] = []string{"text/plain; charset=utf-8"}
+	body := fmt.Sprintf("%s %s %s\n", from.Address(), verb, id)
+	msg.Body = strings.NewReader(body)
 	return msg, nil
 }
 
+// summarise returns the first n characters of the text in the HTML s.
+func summarise(s string, n int) string {
+	var b strings.Builder
+	var intag bool
+	for _, r := range s {
+		switch {
+		case r == '<':
+			intag = true
+		case r == '>':
+			intag = false
+		case !intag:
+			b.WriteRune(r)
+		}
+	}
+	text := strings.Join(strings.Fields(html.UnescapeString(b.String())), " ")
+	if runes := []rune(text); len(runes) > n {
+		text = string(runes[:n]) + "..."
+	}
+	return text
+}
+
 func indexFollowers(actors []Actor, id string) int {
 	for i := range actors {
 		if actors[i].Followers == id {
@@ -113,14 +321,15 @@ func indexFollowers(actors []Actor, id string) int {
 }
 
 func UnmarshalMail(msg *mail.Message, client *Client) (*Activity, error) {
+	return UnmarshalMailContext(context.Background(), msg, client)
+}
+
+// UnmarshalMailContext is like UnmarshalMail but uses ctx for any
+// requests made to look up recipients and posts.
+func UnmarshalMailContext(ctx context.Context, msg *mail.Message, client *Client) (*Activity, error) {
 	if client == nil {
 		client = &DefaultClient
 	}
-	ct := msg.Header.Get("Content-Type")
-	if strings.HasPrefix(ct, "multipart") {
-		return nil, fmt.Errorf("cannot unmarshal from multipart message")
-	}
-
 	date, err := msg.Header.Date()
 	if err != nil {
 		return nil, fmt.Errorf("parse message date: %w", err)
@@ -129,7 +338,7 @@ func UnmarshalMail(msg *mail.Message, client *Client) (*Activity, error) {
 	if err != nil {
 		return nil, fmt.Errorf("parse From: %w", err)
 	}
-	wfrom, err := client.Finger(from[0].Address)
+	wfrom, err := client.FingerContext(ctx, from[0].Address)
 	if err != nil {
 		return nil, fmt.Errorf("webfinger From: %w", err)
 	}
@@ -143,7 +352,7 @@ func UnmarshalMail(msg *mail.Message, client *Client) (*Activity, error) {
 		if err != nil {
 			return nil, fmt.Errorf("parse To address list: %w", err)
 		}
-		actors, err := client.fingerAll(to)
+		actors, err := client.fingerAll(ctx, to)
 		if err != nil {
 			return nil, fmt.Errorf("webfinger To addresses: %w", err)
 		}
@@ -151,6 +360,9 @@ func UnmarshalMail(msg *mail.Message, client *Client) (*Activity, error) {
 		for i, a := range actors {
 			addr := strings.Trim(to[i].Address, "<>")
 			if strings.Contains(addr, "+followers") {
+				if a.Followers == "" {
+					return nil, fmt.Errorf("%s has no followers collection", a.ID)
+				}
 				wto[i] = a.Followers
 				continue
 			}
@@ -163,13 +375,16 @@ func UnmarshalMail(msg *mail.Message, client *Client) (*Activity, error) {
 		if err != nil {
 			return nil, fmt.Errorf("parse CC address list: %w", err)
 		}
-		actors, err := client.fingerAll(cc)
+		actors, err := client.fingerAll(ctx, cc)
 		if err != nil {
 			return nil, fmt.Errorf("webfinger CC addresses: %w", err)
 		}
 		wcc = make([]string, len(actors))
 		for i, a := range actors {
 			if strings.Contains(cc[i].Address, "+followers") {
+				if a.Followers == "" {
+					return nil, fmt.Errorf("%s has no followers collection", a.ID)
+				}
 				wcc[i] = a.Followers
 				continue
 			}
@@ -177,32 +392,297 @@ func UnmarshalMail(msg *mail.Message, client *Client) (*Activity, error) {
 		}
 	}
 
-	buf := &bytes.Buffer{}
-	if msg.Header.Get("Content-Transfer-Encoding") == "quoted-printable" {
-		_, err = io.Copy(buf, quotedprintable.NewReader(msg.Body))
-	} else {
-		_, err = io.Copy(buf, msg.Body)
+	var attachments []Attachment
+	text, mediaType, err := readText(textproto.MIMEHeader(msg.Header), msg.Body, &attachments)
+	if err != nil {
+		return nil, fmt.Errorf("read message body: %w", err)
 	}
+	content := strings.TrimSpace(strings.ReplaceAll(text, "\r", ""))
+	if mediaType == "" {
+		// no text at all, such as a message of only attachments.
+		mediaType = "text/markdown"
+	}
+
+	typ, err := reactionType(msg.Header, content)
 	if err != nil {
-		return nil, fmt.Errorf("read message body: %v", err)
+		return nil, err
+	} else if typ != "" {
+		return unmarshalReaction(ctx, msg.Header, client, typ, wfrom, wto, wcc, date)
 	}
-	content := strings.TrimSpace(strings.ReplaceAll(buf.String(), "\r", ""))
 
-	return &Activity{
+	note := &Activity{
 		AtContext:    NormContext,
 		Type:         "Note",
 		AttributedTo: wfrom.ID,
 		To:           wto,
 		CC:           wcc,
-		MediaType:    "text/markdown",
+		MediaType:    mediaType,
 		Name:         strings.TrimSpace(msg.Header.Get("Subject")),
 		Content:      content,
-		InReplyTo:    strings.Trim(msg.Header.Get("In-Reply-To"), "<>"),
+		InReplyTo:    inReplyTo(msg.Header),
 		Published:    &date,
 		Tag:          tags,
+		Attachment:   attachments,
+	}
+	if mediaType == "text/markdown" {
+		note.Source.Content = content
+		note.Source.MediaType = mediaType
+	}
+	// A message superseding another is an edit of the original.
+	if sup := msg.Header.Get("Supersedes"); sup != "" {
+		note.ID = unversion(strings.Trim(sup, "<> "))
+		note.Updated = &date
+	}
+	return note, nil
+}
+
+// inReplyTo returns the ID of the post which a message replies to.
+// Some clients list the message replied to only in References,
+// where it is the last ID.
+func inReplyTo(header mail.Header) string {
+	id := strings.Trim(header.Get("In-Reply-To"), "<> ")
+	if id == "" {
+		refs := strings.Fields(header.Get("References"))
+		if len(refs) > 0 {
+			id = strings.Trim(refs[len(refs)-1], "<>,")
+		}
+	}
+	return unversion(id)
+}
+
+// readText returns the text of a message body, or MIME part, with the given header.
+// Multipart bodies are walked to find their text:
+// of alternatives, plain text is preferred over HTML;
+// other multipart bodies have the text of their inline parts joined.
+// Plain text is returned with the media type text/markdown.
+// Images, audio and video found along the way are appended to media.
+func readText(header textproto.MIMEHeader, body io.Reader, media *[]Attachment) (text, mediaType string, err error) {
+	mt, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		if header.Get("Content-Type") != "" {
+			return "", "", fmt.Errorf("parse content type: %w", err)
+		}
+		mt = "text/plain"
+	}
+	if strings.HasPrefix(mt, "multipart/") {
+		return readMultipart(mt, multipart.NewReader(body, params["boundary"]), media)
+	}
+	if mt == "message/external-body" {
+		att, err := externalAttachment(params, body)
+		if err == nil && isMedia(att.MediaType) {
+			*media = append(*media, att)
+		}
+		return "", "", nil
+	}
+	switch {
+	case mt == "text/plain", mt == "text/markdown":
+		mediaType = "text/markdown"
+	case mt == "text/html":
+		mediaType = "text/html"
+	case isMedia(mt):
+	default:
+		return "", "", nil
+	}
+	switch strings.ToLower(header.Get("Content-Transfer-Encoding")) {
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	}
+	b, err := io.ReadAll(body)
+	if err != nil {
+		return "", "", err
+	}
+	if mediaType == "" {
+		*media = append(*media, newAttachment(mt, header, b))
+		return "", "", nil
+	}
+	text, err = decodeCharset(params["charset"], b)
+	if err != nil {
+		// Text passed through as it is beats refusing the whole message.
+		log.Printf("read %s: %v: using text undecoded", mediaType, err)
+		text = string(b)
+	}
+	return text, mediaType, nil
+}
+
+// decodeCharset returns b, text in the named character set, as UTF-8.
+// Besides UTF-8 and its subset US-ASCII, only ISO-8859-1 and
+// Windows-1252 are supported; these are about all mail clients
+// send that isn't UTF-8.
+func decodeCharset(charset string, b []byte) (string, error) {
+	switch strings.ToLower(charset) {
+	case "", "utf-8", "utf8", "us-ascii":
+		return string(b), nil
+	case "iso-8859-1", "latin1":
+		// bytes are code points.
+		buf := &strings.Builder{}
+		for _, c := range b {
+			buf.WriteRune(rune(c))
+		}
+		return buf.String(), nil
+	case "windows-1252", "cp1252":
+		buf := &strings.Builder{}
+		for _, c := range b {
+			if c >= 0x80 && c < 0xa0 && cp1252[c-0x80] != 0 {
+				buf.WriteRune(cp1252[c-0x80])
+				continue
+			}
+			buf.WriteRune(rune(c))
+		}
+		return buf.String(), nil
+	}
+	return "", fmt.Errorf("unsupported charset %q", charset)
+}
+
+// cp1252 maps bytes 0x80 to 0x9f of Windows-1252 to Unicode.
+// Otherwise it matches ISO-8859-1. Unassigned bytes are zero.
+var cp1252 = [32]rune{
+	'€', 0, '‚', 'ƒ', '„', '…', '†', '‡', 'ˆ', '‰', 'Š', '‹', 'Œ', 0, 'Ž', 0,
+	0, '‘', '’', '“', '”', '•', '–', '—', '˜', '™', 'š', '›', 'œ', 0, 'ž', 'Ÿ',
+}
+
+func readMultipart(mt string, r *multipart.Reader, media *[]Attachment) (text, mediaType string, err error) {
+	var texts []string
+	// media of the chosen alternative;
+	// the others' are only for rendering their own text.
+	var chosen []Attachment
+	for {
+		part, err := r.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return "", "", err
+		}
+		// attached text files are not part of the post.
+		disp, _, _ := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+		if ct := part.Header.Get("Content-Type"); disp == "attachment" && (ct == "" || strings.HasPrefix(strings.ToLower(ct), "text/")) {
+			continue
+		}
+		partMedia := media
+		if mt == "multipart/alternative" {
+			partMedia = new([]Attachment)
+		}
+		t, typ, err := readText(part.Header, part, partMedia)
+		if err != nil {
+			return "", "", err
+		}
+		if typ == "" {
+			continue
+		}
+		if mt == "multipart/alternative" {
+			// take the first alternative, unless a plain one follows HTML.
+			if mediaType == "" || mediaType == "text/html" && typ == "text/markdown" {
+				text, mediaType = t, typ
+				chosen = *partMedia
+			}
+			continue
+		}
+		if mediaType == "" {
+			mediaType = typ
+		}
+		if typ == mediaType {
+			texts = append(texts, strings.TrimSpace(t))
+		}
+	}
+	if mt == "multipart/alternative" {
+		*media = append(*media, chosen...)
+		return text, mediaType, nil
+	}
+	if mediaType == "text/html" {
+		return strings.Join(texts, "\n"), mediaType, nil
+	}
+	return strings.Join(texts, "\n\n"), mediaType, nil
+}
+
+// reactionType returns the type of activity, such as Like,
+// requested by a message instead of a Note, if any.
+// The type is set explicitly in the X-Activity-Type header.
+// A message with the subject "+1" and no text of its own,
+// other than quoting the message it replies to, is a Like.
+func reactionType(header mail.Header, body string) (string, error) {
+	if t := strings.TrimSpace(header.Get("X-Activity-Type")); t != "" {
+		for _, typ := range []string{"Like", "Dislike", "Announce"} {
+			if strings.EqualFold(t, typ) {
+				return typ, nil
+			}
+		}
+		return "", fmt.Errorf("unsupported activity type %q", t)
+	}
+	subject := strings.TrimSpace(header.Get("Subject"))
+	for strings.HasPrefix(strings.ToLower(subject), "re:") {
+		subject = strings.TrimSpace(subject[len("re:"):])
+	}
+	if subject != "+1" {
+		return "", nil
+	}
+	for _, line := range strings.Split(body, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, ">") || strings.HasSuffix(line, "wrote:") {
+			continue
+		}
+		return "", nil
+	}
+	return "Like", nil
+}
+
+// unmarshalReaction returns an activity of type typ, such as a Like,
+// of the post which the message with header replies to.
+// The author of the post is always addressed,
+// and an Announce is addressed to the public.
+func unmarshalReaction(ctx context.Context, header mail.Header, client *Client, typ string, from *Actor, to, cc []string, date time.Time) (*Activity, error) {
+	irt := inReplyTo(header)
+	if irt == "" {
+		return nil, fmt.Errorf("%s must be a reply to the post", typ)
+	}
+	post, err := client.LookupContext(ctx, irt)
+	if err != nil {
+		return nil, fmt.Errorf("lookup %s: %w", irt, err)
+	}
+	author := post.AttributedTo
+	if author == "" {
+		author = post.Actor
+	}
+	if author != "" && !contains(to, author) && !contains(cc, author) {
+		to = append(to, author)
+	}
+	if typ == "Announce" {
+		to = append(to, PublicCollection)
+		if from.Followers != "" && !contains(cc, from.Followers) {
+			cc = append(cc, from.Followers)
+		}
+	}
+	object, err := json.Marshal(post.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &Activity{
+		AtContext: NormContext,
+		Type:      typ,
+		Actor:     from.ID,
+		To:        to,
+		CC:        cc,
+		Published: &date,
+		Object:    object,
 	}, nil
 }
 
+// unversion returns the ID of the Activity referenced by id,
+// a Message-ID of a message created from an edit of the Activity.
+// See marshalMail.
+func unversion(id string) string {
+	i := strings.LastIndex(id, "#")
+	if i < 0 || i == len(id)-1 {
+		return id
+	}
+	for _, c := range id[i+1:] {
+		if c < '0' || c > '9' {
+			return id
+		}
+	}
+	return id[:i]
+}
+
 func SendMail(addr string, auth smtp.Auth, from string, to []string, activity *Activity) error {
 	msg, err := MarshalMail(activity, nil)
 	if err != nil {
@@ -211,20 +691,138 @@ func SendMail(addr string, auth smtp.Auth, from string, to []string, activity *A
 	return smtp.SendMail(addr, auth, from, to, msg)
 }
 
+// encodeMsg returns msg encoded as described in RFC 5322 and RFC 2045:
+// lines end in CRLF, non-ASCII header text is encoded as in RFC 2047,
+// long header lines are folded,
+// and bodies which are not 7-bit text are given a transfer encoding.
+// Empty header fields are omitted.
 func encodeMsg(msg *mail.Message) []byte {
-	buf := &bytes.Buffer{}
-	// Lead with "From", end with "Subject" to make some mail clients happy.
-	fmt.Fprintln(buf, "From:", msg.Header.Get("From"))
+	header := make(mail.Header)
 	for k, v := range msg.Header {
+		header[k] = v
+	}
+	body, _ := io.ReadAll(msg.Body)
+	ct := header.Get("Content-Type")
+	if ct != "" {
+		header["MIME-Version"] = []string{"1.0"}
+		if !strings.HasPrefix(ct, "multipart/") && header.Get("Content-Transfer-Encoding") == "" {
+			var cte string
+			cte, body = transferEncode(ct, body)
+			if cte != "" {
+				header["Content-Transfer-Encoding"] = []string{cte}
+			}
+		}
+	}
+
+	keys := make([]string, 0, len(header))
+	for k := range header {
 		switch k {
-		case "Subject", "From":
+		case "From", "Subject":
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	// Lead with "From", end with "Subject" to make some mail clients happy.
+	keys = append(append([]string{"From"}, keys...), "Subject")
+
+	buf := &bytes.Buffer{}
+	for _, k := range keys {
+		var values []string
+		for _, v := range header[k] {
+			if v = strings.TrimSpace(v); v != "" {
+				values = append(values, v)
+			}
+		}
+		if len(values) == 0 {
 			continue
+		}
+		var field string
+		switch k {
+		case "From", "To", "CC", "Cc", "Bcc", "Reply-To", "Sender":
+			// already encoded by mail.Address.
+			field = k + ": " + strings.Join(values, ", ")
 		default:
-			fmt.Fprintf(buf, "%s: %s\n", k, strings.Join(v, ", "))
+			for i := range values {
+				values[i] = mime.QEncoding.Encode("utf-8", values[i])
+			}
+			field = k + ": " + strings.Join(values, " ")
 		}
+		buf.WriteString(foldHeader(field))
+		buf.WriteString("\r\n")
 	}
-	fmt.Fprintln(buf, "Subject:", msg.Header.Get("Subject"))
-	fmt.Fprintln(buf)
-	io.Copy(buf, msg.Body)
+	buf.WriteString("\r\n")
+	buf.Write(body)
 	return buf.Bytes()
 }
+
+// maxLineLen is the length at which header lines are folded.
+// See RFC 5322 section 2.1.1.
+const maxLineLen = 78
+
+// foldHeader folds the header field line at whitespace
+// so that no line is longer than maxLineLen, where possible.
+func foldHeader(line string) string {
+	var b strings.Builder
+	for len(line) > maxLineLen {
+		i := strings.LastIndexAny(line[:maxLineLen], " \t")
+		if i <= 0 {
+			// no whitespace to fold at; find the next.
+			i = strings.IndexAny(line[maxLineLen:], " \t")
+			if i < 0 {
+				break
+			}
+			i += maxLineLen
+		}
+		b.WriteString(line[:i])
+		b.WriteString("\r\n")
+		line = line[i:]
+	}
+	b.WriteString(line)
+	return b.String()
+}
+
+// transferEncode returns body, of the given content type, encoded for mail
+// and the name of the Content-Transfer-Encoding used.
+// Text which is only 7-bit ASCII in short lines is left as is
+// but with CRLF line endings, and the empty name is returned.
+// Other text is encoded as quoted-printable, and anything else as base64.
+func transferEncode(contentType string, body []byte) (cte string, encoded []byte) {
+	buf := &bytes.Buffer{}
+	if !strings.HasPrefix(contentType, "text/") {
+		enc := base64.StdEncoding.EncodeToString(body)
+		for len(enc) > 76 {
+			buf.WriteString(enc[:76] + "\r\n")
+			enc = enc[76:]
+		}
+		buf.WriteString(enc + "\r\n")
+		return "base64", buf.Bytes()
+	}
+	if is7bit(body) {
+		text := strings.ReplaceAll(string(body), "\r\n", "\n")
+		return "", []byte(strings.ReplaceAll(text, "\n", "\r\n"))
+	}
+	w := quotedprintable.NewWriter(buf)
+	w.Write(body)
+	w.Close()
+	return "quoted-printable", buf.Bytes()
+}
+
+// is7bit reports whether b is ASCII text with lines
+// no longer than permitted by RFC 5322.
+func is7bit(b []byte) bool {
+	n := 0
+	for _, c := range b {
+		if c >= 0x80 || c == 0 {
+			return false
+		}
+		if c == '\n' {
+			n = 0
+			continue
+		}
+		if n++; n > 998 {
+			return false
+		}
+	}
+	return true
+}
@@ -2,13 +2,22 @@ package apub
 
 import (
 	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/http/httptest"
 	"net/mail"
+	"net/textproto"
 	"os"
 	"reflect"
 	"sort"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestMailAddress(t *testing.T) {
@@ -189,3 +198,359 @@ func TestUnmarshalMail(t *testing.T) {
 	}
 	t.Log(a)
 }
+
+func TestMarshalEdit(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", ContentType)
+		http.ServeFile(w, req, "testdata/actor/apas.json")
+	}))
+	defer srv.Close()
+	client := &Client{Client: srv.Client()}
+
+	published := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	updated := published.Add(time.Hour)
+	note := &Activity{
+		ID:           "https://apubtest2.srcbeat.com/otl/outbox/1",
+		Type:         "Note",
+		AttributedTo: srv.URL + "/otl/actor.json",
+		Content:      "hello, world!",
+		Published:    &published,
+		Updated:      &updated,
+	}
+	msg, err := marshalMail(context.Background(), note, client, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(msg.Header["Supersedes"], ""); got != "<"+note.ID+">" {
+		t.Errorf("Supersedes: got %q, want %q", got, "<"+note.ID+">")
+	}
+	id := msg.Header["Message-ID"][0]
+	if id == "<"+note.ID+">" {
+		t.Errorf("edit has same Message-ID as original")
+	}
+	if got := unversion(strings.Trim(id, "<>")); got != note.ID {
+		t.Errorf("unversion %s: got %s, want %s", id, got, note.ID)
+	}
+	if got := unversion("https://example.com/notes/1#reply"); got != "https://example.com/notes/1#reply" {
+		t.Errorf("unversion removed non-numeric fragment: %s", got)
+	}
+}
+
+func TestMarshalNotification(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", ContentType)
+		if req.URL.Path == "/notes/1" {
+			w.Write([]byte(`{"id": "https://example.com/notes/1", "type": "Note", "content": "<p>Hello, <b>world</b>!</p>"}`))
+			return
+		}
+		http.ServeFile(w, req, "testdata/actor/apas.json")
+	}))
+	defer srv.Close()
+	client := &Client{Client: srv.Client()}
+
+	like := &Activity{
+		ID:     "https://apubtest2.srcbeat.com/otl/likes/1",
+		Type:   "Like",
+		Actor:  srv.URL + "/otl/actor.json",
+		Object: []byte(`"` + srv.URL + `/notes/1"`),
+	}
+	msg, err := marshalMail(context.Background(), like, client, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "<" + srv.URL + "/notes/1>"
+	if got := strings.Join(msg.Header["In-Reply-To"], ""); got != want {
+		t.Errorf("In-Reply-To: got %q, want %q", got, want)
+	}
+	if got := strings.Join(msg.Header["From"], ""); got != `"Oliver Lowe" <otl@apubtest2.srcbeat.com>` {
+		t.Errorf("unexpected From %q", got)
+	}
+	subject := strings.Join(msg.Header["Subject"], "")
+	if subject != `Oliver Lowe liked "Hello, world!"` {
+		t.Errorf("unexpected Subject %q", subject)
+	}
+}
+
+func TestReactionType(t *testing.T) {
+	tests := []struct {
+		header string
+		body   string
+		want   string
+	}{
+		{"Subject: +1", "", "Like"},
+		{"Subject: Re: +1", "On Mon, Alice wrote:\n> hello", "Like"},
+		{"Subject: +1", "I agree!", ""},
+		{"Subject: Re: hello", "", ""},
+		{"Subject: Re: hello\nX-Activity-Type: announce", "", "Announce"},
+		{"Subject: Re: hello\nX-Activity-Type: Dislike", "boo", "Dislike"},
+	}
+	for _, tt := range tests {
+		msg, err := mail.ReadMessage(strings.NewReader(tt.header + "\n\n" + tt.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := reactionType(msg.Header, tt.body)
+		if err != nil {
+			t.Errorf("%q: %v", tt.header, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%q %q: got %q, want %q", tt.header, tt.body, got, tt.want)
+		}
+	}
+	msg, _ := mail.ReadMessage(strings.NewReader("X-Activity-Type: Block\n\n"))
+	if _, err := reactionType(msg.Header, ""); err == nil {
+		t.Errorf("no error for unsupported activity type")
+	}
+}
+
+func TestUnmarshalReaction(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", ContentType)
+		w.Write([]byte(`{"id": "https://example.com/notes/1", "type": "Note", "attributedTo": "https://example.com/alice"}`))
+	}))
+	defer srv.Close()
+	client := &Client{Client: srv.Client()}
+	from := &Actor{ID: "https://apubtest2.srcbeat.com/otl/actor.json", Followers: "https://apubtest2.srcbeat.com/otl/followers"}
+	header := mail.Header{"In-Reply-To": []string{"<" + srv.URL + "/notes/1>"}}
+
+	announce, err := unmarshalReaction(context.Background(), header, client, "Announce", from, nil, nil, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !contains(announce.To, PublicCollection) || !contains(announce.To, "https://example.com/alice") {
+		t.Errorf("Announce not addressed to the public and the author: to %v", announce.To)
+	}
+	if !contains(announce.CC, from.Followers) {
+		t.Errorf("Announce not copied to followers: cc %v", announce.CC)
+	}
+	like, err := unmarshalReaction(context.Background(), header, client, "Like", from, nil, nil, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contains(like.To, PublicCollection) || contains(like.CC, from.Followers) {
+		t.Errorf("Like addressed beyond the author: to %v, cc %v", like.To, like.CC)
+	}
+}
+
+func TestReadText(t *testing.T) {
+	tests := []struct {
+		name      string
+		want      string
+		mediaType string
+	}{
+		{"testdata/mime/alternative.eml", "Hello, this line is long enough that Mail.app wraps it with a soft line break.", "text/markdown"},
+		{"testdata/mime/mixed.eml", "Look at this", "text/markdown"},
+		{"testdata/mime/latin1.eml", "Grüße aus Köln", "text/markdown"},
+		{"testdata/mime/windows-1252.eml", "“Café” costs €5 – or so", "text/markdown"},
+		// the inline image belongs to the HTML alternative only.
+		{"testdata/mime/related.eml", "Plain text wins", "text/markdown"},
+	}
+	for _, tt := range tests {
+		f, err := os.Open(tt.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		msg, err := mail.ReadMessage(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var media []Attachment
+		text, mediaType, err := readText(textproto.MIMEHeader(msg.Header), msg.Body, &media)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if len(media) > 0 {
+			t.Errorf("%s: got %d attachments from a message with none", tt.name, len(media))
+		}
+		if got := strings.TrimSpace(text); got != tt.want {
+			t.Errorf("%s: got text %q, want %q", tt.name, got, tt.want)
+		}
+		if mediaType != tt.mediaType {
+			t.Errorf("%s: got media type %q, want %q", tt.name, mediaType, tt.mediaType)
+		}
+	}
+}
+
+func TestReadTextCharset(t *testing.T) {
+	// unsupported charsets are passed through rather than refused.
+	header := textproto.MIMEHeader{"Content-Type": []string{"text/plain; charset=shift_jis"}}
+	text, _, err := readText(header, strings.NewReader("\x82\xb1\x82\xf1"), new([]Attachment))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text != "\x82\xb1\x82\xf1" {
+		t.Errorf("text in unsupported charset changed: got %q", text)
+	}
+}
+
+// HTML with inline images, when it's the only alternative, keeps them.
+func TestReadTextRelated(t *testing.T) {
+	body := "--rel\r\nContent-Type: text/html\r\n\r\n<p>hi</p>\r\n--rel\r\nContent-Type: image/png\r\n\r\npng\r\n--rel--\r\n"
+	related := "--alt\r\nContent-Type: multipart/related; boundary=rel\r\n\r\n" + body + "--alt--\r\n"
+	header := textproto.MIMEHeader{"Content-Type": []string{"multipart/alternative; boundary=alt"}}
+	var media []Attachment
+	if _, _, err := readText(header, strings.NewReader(related), &media); err != nil {
+		t.Fatal(err)
+	}
+	if len(media) != 1 {
+		t.Errorf("want 1 attachment from chosen alternative, got %d", len(media))
+	}
+}
+
+func TestEncodeMsg(t *testing.T) {
+	subject := "Ünïcödé subject which is long enough that it must be folded over more than one line"
+	body := "Grüße aus Köln!\nThis line is plain.\n"
+	msg := &mail.Message{
+		Header: mail.Header{
+			"From":         []string{(&mail.Address{Name: "Zoë", Address: "zoe@example.com"}).String()},
+			"To":           []string{},
+			"CC":           []string{""},
+			"Subject":      []string{subject},
+			"Message-ID":   []string{"<https://example.com/note/1>"},
+			"Content-Type": []string{"text/plain; charset=utf-8"},
+		},
+		Body: strings.NewReader(body),
+	}
+	b := encodeMsg(msg)
+	for i, line := range strings.SplitAfter(string(b), "\n") {
+		if line == "" {
+			continue
+		}
+		if !strings.HasSuffix(line, "\r\n") {
+			t.Errorf("line %d %q does not end in CRLF", i, line)
+		}
+		if len(line) > maxLineLen+2 {
+			t.Errorf("line %d is %d characters long", i, len(line))
+		}
+	}
+	for _, c := range b {
+		if c >= 0x80 {
+			t.Fatalf("message contains 8-bit data:\n%s", b)
+		}
+	}
+
+	got, err := mail.ReadMessage(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"To", "CC"} {
+		if _, ok := got.Header[textproto.CanonicalMIMEHeaderKey(k)]; ok {
+			t.Errorf("empty %s header included", k)
+		}
+	}
+	if got.Header.Get("MIME-Version") != "1.0" {
+		t.Errorf("missing MIME-Version")
+	}
+	dec := new(mime.WordDecoder)
+	if s, err := dec.DecodeHeader(got.Header.Get("Subject")); err != nil || s != subject {
+		t.Errorf("got subject %q, %v, want %q", s, err, subject)
+	}
+	from, err := got.Header.AddressList("From")
+	if err != nil || from[0].Name != "Zoë" {
+		t.Errorf("got From %v, %v", from, err)
+	}
+	text, _, err := readText(textproto.MIMEHeader(got.Header), got.Body, new([]Attachment))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.ReplaceAll(text, "\r\n", "\n") != body {
+		t.Errorf("got body %q, want %q", text, body)
+	}
+}
+
+func TestReferences(t *testing.T) {
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", ContentType)
+		parent := map[string]string{
+			"/notes/1": "",
+			"/notes/2": "/notes/1",
+			"/notes/3": "/notes/2",
+			// a reply to itself shouldn't loop forever.
+			"/notes/loop": "/notes/loop",
+		}
+		irt, ok := parent[req.URL.Path]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		if irt != "" {
+			irt = srv.URL + irt
+		}
+		fmt.Fprintf(w, `{"id": %q, "type": "Note", "inReplyTo": %q}`, srv.URL+req.URL.Path, irt)
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		parent string
+		depth  int
+		want   []string
+	}{
+		{"/notes/3", 0, []string{"/notes/3"}},
+		{"/notes/3", 1, []string{"/notes/2", "/notes/3"}},
+		{"/notes/3", 10, []string{"/notes/1", "/notes/2", "/notes/3"}},
+		{"/notes/loop", 10, []string{"/notes/loop"}},
+		{"/notes/missing", 10, []string{"/notes/missing"}},
+	}
+	for _, tt := range tests {
+		client := &Client{Client: srv.Client()}
+		got := client.references(context.Background(), srv.URL+tt.parent, tt.depth)
+		want := make([]string, len(tt.want))
+		for i := range tt.want {
+			want[i] = srv.URL + tt.want[i]
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s depth %d: got %v, want %v", tt.parent, tt.depth, got, want)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	client := &Client{Client: srv.Client()}
+	if got := client.references(ctx, srv.URL+"/notes/3", 10); len(got) != 1 {
+		t.Errorf("thread looked up after context cancelled: got %v", got)
+	}
+}
+
+func TestInReplyTo(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{"In-Reply-To: <https://example.com/notes/2>\nReferences: <https://example.com/notes/1> <https://example.com/notes/2>", "https://example.com/notes/2"},
+		{"References: <https://example.com/notes/1>\n <https://example.com/notes/2#1700000000>", "https://example.com/notes/2"},
+		{"Subject: hello", ""},
+	}
+	for _, tt := range tests {
+		msg, err := mail.ReadMessage(strings.NewReader(tt.header + "\n\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := inReplyTo(msg.Header); got != tt.want {
+			t.Errorf("%q: got %q, want %q", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestThreadIndex(t *testing.T) {
+	var a Activity
+	if err := json.Unmarshal([]byte(`{"type": "Note", "context": {"id": "https://example.com/contexts/1", "type": "OrderedCollection"}}`), &a); err != nil {
+		t.Fatal(err)
+	}
+	if a.Context != "https://example.com/contexts/1" {
+		t.Errorf("context object: got ID %q", a.Context)
+	}
+	idx := threadIndex(a.Context)
+	if idx != threadIndex("https://example.com/contexts/1") {
+		t.Errorf("thread index not stable")
+	}
+	if idx == threadIndex("https://example.com/contexts/2") {
+		t.Errorf("same thread index for different threads")
+	}
+	if b, err := base64.StdEncoding.DecodeString(idx); err != nil || len(b) != 22 {
+		t.Errorf("thread index %q is not 22 bytes of base64: %v", idx, err)
+	}
+}
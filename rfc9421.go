@@ -0,0 +1,383 @@
+package apub
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SignatureScheme identifies a specification for signing HTTP requests.
+type SignatureScheme int
+
+const (
+	// Cavage is the scheme from draft-cavage-http-signatures-12,
+	// using the Signature and Digest headers.
+	// It is understood by practically all ActivityPub servers.
+	Cavage SignatureScheme = iota
+	// RFC9421 is the scheme from RFC 9421 HTTP Message Signatures,
+	// using the Signature-Input, Signature and Content-Digest headers.
+	RFC9421
+)
+
+func (s SignatureScheme) String() string {
+	switch s {
+	case Cavage:
+		return "draft-cavage"
+	case RFC9421:
+		return "rfc9421"
+	}
+	return "SignatureScheme(" + strconv.Itoa(int(s)) + ")"
+}
+
+// sigLabel is the label of the signatures we create.
+const sigLabel = "sig1"
+
+// SignRFC9421 signs req as described in RFC 9421 with key.
+// keyID is the URL where the corresponding public key may be accessed.
+// The signature covers the method, target URI and,
+// if req has a body, the Content-Digest header.
+// RSA and Ed25519 keys are supported.
+func SignRFC9421(req *http.Request, key crypto.Signer, keyID string) error {
+	if keyID == "" {
+		return fmt.Errorf("no key id")
+	}
+	components := []string{"@method", "@target-uri"}
+	if req.Body != nil {
+		buf := &bytes.Buffer{}
+		io.Copy(buf, req.Body)
+		req.Body.Close()
+		req.Body = io.NopCloser(buf)
+		req.Header.Set("Content-Digest", contentDigest(buf.Bytes()))
+		components = append(components, "content-digest")
+	}
+	quoted := make([]string, len(components))
+	for i := range components {
+		quoted[i] = strconv.Quote(components[i])
+	}
+	alg, err := algorithm(key.Public())
+	if err != nil {
+		return err
+	}
+	params := fmt.Sprintf("(%s);created=%d;keyid=%q;alg=%q", strings.Join(quoted, " "), time.Now().Unix(), keyID, alg)
+	base, err := signatureBase(req, components, params)
+	if err != nil {
+		return err
+	}
+	sig, err := signMessage(key, []byte(base))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Signature-Input", sigLabel+"="+params)
+	req.Header.Set("Signature", sigLabel+"=:"+base64.StdEncoding.EncodeToString(sig)+":")
+	return nil
+}
+
+func verifyRFC9421(req *http.Request, fetchKey func(keyID string) (crypto.PublicKey, error)) (string, error) {
+	inputs, err := parseDictionary(req.Header.Get("Signature-Input"))
+	if err != nil {
+		return "", fmt.Errorf("parse signature-input header: %w", err)
+	}
+	sigs, err := parseDictionary(req.Header.Get("Signature"))
+	if err != nil {
+		return "", fmt.Errorf("parse signature header: %w", err)
+	}
+	if len(inputs) == 0 {
+		return "", fmt.Errorf("empty signature-input header")
+	}
+	// Verify the first signature; we have no use for more.
+	label, params := inputs[0].key, inputs[0].value
+	var bsig string
+	for i := range sigs {
+		if sigs[i].key == label {
+			bsig = sigs[i].value
+		}
+	}
+	if bsig == "" {
+		return "", fmt.Errorf("no signature labelled %s", label)
+	}
+	if !strings.HasPrefix(bsig, ":") || !strings.HasSuffix(bsig, ":") || len(bsig) < 2 {
+		return "", fmt.Errorf("signature %s is not a byte sequence", label)
+	}
+	sig, err := base64.StdEncoding.DecodeString(bsig[1 : len(bsig)-1])
+	if err != nil {
+		return "", fmt.Errorf("decode signature: %w", err)
+	}
+
+	components, sp, err := parseSignatureParams(params)
+	if err != nil {
+		return "", fmt.Errorf("parse signature parameters: %w", err)
+	}
+	if sp.keyID == "" {
+		return "", fmt.Errorf("missing signature parameter keyid")
+	}
+	if sp.created == 0 {
+		return "", fmt.Errorf("missing signature parameter created")
+	}
+	created := time.Unix(sp.created, 0)
+	if age := time.Since(created); age > MaxSignatureAge || age < -MaxSignatureAge {
+		return "", fmt.Errorf("signature created %s outside of accepted range", created)
+	}
+	if sp.expires > 0 && time.Now().After(time.Unix(sp.expires, 0)) {
+		return "", fmt.Errorf("signature expired")
+	}
+	if !contains(components, "@method") {
+		return "", fmt.Errorf("method not signed")
+	}
+	if !contains(components, "@target-uri") && !contains(components, "@path") && !contains(components, "@request-target") {
+		return "", fmt.Errorf("request target not signed")
+	}
+
+	if req.Body != nil && req.Body != http.NoBody {
+		buf := &bytes.Buffer{}
+		_, err := io.Copy(buf, req.Body)
+		req.Body.Close()
+		req.Body = io.NopCloser(buf)
+		if err != nil {
+			return "", fmt.Errorf("read body: %w", err)
+		}
+		if buf.Len() > 0 {
+			if !contains(components, "content-digest") {
+				return "", fmt.Errorf("content digest not signed")
+			}
+			if err := checkContentDigest(req.Header.Get("Content-Digest"), buf.Bytes()); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	base, err := signatureBase(req, components, params)
+	if err != nil {
+		return "", err
+	}
+	pubkey, err := fetchKey(sp.keyID)
+	if err != nil {
+		return "", fmt.Errorf("fetch key %s: %w", sp.keyID, err)
+	}
+	if sp.alg != "" {
+		alg, err := algorithm(pubkey)
+		if err != nil {
+			return "", err
+		}
+		if sp.alg != alg {
+			return "", fmt.Errorf("algorithm %s does not match %s key", sp.alg, alg)
+		}
+	}
+	if err := verifyMessage(pubkey, []byte(base), sig); err != nil {
+		return "", fmt.Errorf("verify signature: %w", err)
+	}
+	return sp.keyID, nil
+}
+
+// algorithm returns the name of the RFC 9421 signature algorithm for pub.
+func algorithm(pub crypto.PublicKey) (string, error) {
+	switch pub.(type) {
+	case *rsa.PublicKey:
+		return "rsa-v1_5-sha256", nil
+	case ed25519.PublicKey:
+		return "ed25519", nil
+	}
+	return "", fmt.Errorf("unsupported key type %T", pub)
+}
+
+// signatureBase returns the signature base for req
+// as described in RFC 9421 section 2.5.
+// params is the serialised value of the @signature-params component.
+func signatureBase(req *http.Request, components []string, params string) (string, error) {
+	buf := &strings.Builder{}
+	for _, c := range components {
+		v, err := componentValue(req, c)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(buf, "%q: %s\n", c, v)
+	}
+	fmt.Fprintf(buf, "%q: %s", "@signature-params", params)
+	return buf.String(), nil
+}
+
+func componentValue(req *http.Request, name string) (string, error) {
+	switch name {
+	case "@method":
+		return req.Method, nil
+	case "@target-uri":
+		return targetURI(req), nil
+	case "@authority":
+		return strings.ToLower(requestHost(req)), nil
+	case "@scheme":
+		scheme, _, _ := strings.Cut(targetURI(req), ":")
+		return scheme, nil
+	case "@request-target":
+		return req.URL.RequestURI(), nil
+	case "@path":
+		return req.URL.EscapedPath(), nil
+	case "@query":
+		return "?" + req.URL.RawQuery, nil
+	}
+	if strings.HasPrefix(name, "@") {
+		return "", fmt.Errorf("unsupported derived component %s", name)
+	}
+	values := req.Header.Values(name)
+	if len(values) == 0 {
+		return "", fmt.Errorf("missing signed header %s", name)
+	}
+	v := make([]string, len(values))
+	for i := range values {
+		v[i] = strings.TrimSpace(values[i])
+	}
+	return strings.Join(v, ", "), nil
+}
+
+// targetURI returns the absolute URL of req.
+// Requests received by a server carry no scheme;
+// we assume they arrived over HTTPS as ActivityPub requires.
+func targetURI(req *http.Request) string {
+	if req.URL.IsAbs() {
+		return req.URL.String()
+	}
+	return "https://" + requestHost(req) + req.URL.RequestURI()
+}
+
+func requestHost(req *http.Request) string {
+	if req.Host != "" {
+		return req.Host
+	}
+	return req.URL.Host
+}
+
+// contentDigest returns the value of the Content-Digest header for body.
+// See RFC 9530.
+func contentDigest(body []byte) string {
+	sum := sha256.Sum256(body)
+	return "sha-256=:" + base64.StdEncoding.EncodeToString(sum[:]) + ":"
+}
+
+func checkContentDigest(header string, body []byte) error {
+	digests, err := parseDictionary(header)
+	if err != nil {
+		return fmt.Errorf("parse content-digest header: %w", err)
+	}
+	for _, d := range digests {
+		var sum []byte
+		switch d.key {
+		case "sha-256":
+			b := sha256.Sum256(body)
+			sum = b[:]
+		case "sha-512":
+			b := sha512.Sum512(body)
+			sum = b[:]
+		default:
+			continue
+		}
+		if d.value != ":"+base64.StdEncoding.EncodeToString(sum)+":" {
+			return fmt.Errorf("content digest mismatch")
+		}
+		return nil
+	}
+	return fmt.Errorf("no supported algorithm in content digest")
+}
+
+type member struct {
+	key   string
+	value string
+}
+
+// parseDictionary parses the structured field dictionary in line
+// as described in RFC 8941 section 3.2.
+// Member values are returned as their raw serialisation.
+func parseDictionary(line string) ([]member, error) {
+	var members []member
+	for len(strings.TrimSpace(line)) > 0 {
+		line = strings.TrimLeft(line, " \t")
+		key, rest, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("missing value for member %s", line)
+		}
+		var quoted bool
+		var depth int
+		end := len(rest)
+	Scan:
+		for i := 0; i < len(rest); i++ {
+			switch c := rest[i]; {
+			case c == '\\' && quoted:
+				i++
+			case c == '"':
+				quoted = !quoted
+			case c == '(' && !quoted:
+				depth++
+			case c == ')' && !quoted:
+				depth--
+			case c == ',' && !quoted && depth == 0:
+				end = i
+				break Scan
+			}
+		}
+		if quoted || depth != 0 {
+			return nil, fmt.Errorf("unterminated value for member %s", key)
+		}
+		members = append(members, member{strings.TrimSpace(key), strings.TrimSpace(rest[:end])})
+		if end == len(rest) {
+			break
+		}
+		line = rest[end+1:]
+	}
+	return members, nil
+}
+
+type sigParams struct {
+	keyID   string
+	alg     string
+	created int64
+	expires int64
+}
+
+// parseSignatureParams parses the inner list of covered components
+// and parameters of a signature as found in the Signature-Input header.
+func parseSignatureParams(s string) ([]string, sigParams, error) {
+	var sp sigParams
+	if !strings.HasPrefix(s, "(") {
+		return nil, sp, fmt.Errorf("not an inner list: %s", s)
+	}
+	list, params, ok := strings.Cut(s[1:], ")")
+	if !ok {
+		return nil, sp, fmt.Errorf("unterminated inner list: %s", s)
+	}
+	var components []string
+	for _, item := range strings.Fields(list) {
+		c, err := strconv.Unquote(item)
+		if err != nil {
+			return nil, sp, fmt.Errorf("unsupported component %s", item)
+		}
+		components = append(components, strings.ToLower(c))
+	}
+	for _, p := range strings.Split(params, ";") {
+		if p == "" {
+			continue
+		}
+		name, val, _ := strings.Cut(p, "=")
+		var err error
+		switch name {
+		case "keyid":
+			sp.keyID, err = strconv.Unquote(val)
+		case "alg":
+			sp.alg, err = strconv.Unquote(val)
+		case "created":
+			sp.created, err = strconv.ParseInt(val, 10, 64)
+		case "expires":
+			sp.expires, err = strconv.ParseInt(val, 10, 64)
+		}
+		if err != nil {
+			return nil, sp, fmt.Errorf("parameter %s: %w", name, err)
+		}
+	}
+	return components, sp, nil
+}
@@ -3,7 +3,7 @@ package apub
 import (
 	"bytes"
 	"crypto"
-	"crypto/rand"
+	"crypto/ed25519"
 	"crypto/rsa"
 	"crypto/sha256"
 	"encoding/base64"
@@ -16,42 +16,172 @@ import (
 
 // Sign signs the given HTTP request with the matching private key of the
 // public key available at pubkeyURL.
-func Sign(req *http.Request, key *rsa.PrivateKey, pubkeyURL string) error {
+// RSA keys sign using the rsa-sha256 algorithm;
+// Ed25519 keys sign using hs2019.
+func Sign(req *http.Request, key crypto.Signer, pubkeyURL string) error {
 	if pubkeyURL == "" {
 		return fmt.Errorf("no pubkey url")
 	}
 	date := time.Now().UTC().Format(http.TimeFormat)
 	req.Header.Set("Date", date)
-	hash := sha256.New()
 	toSign := []string{"(request-target)", "host", "date"}
-	fmt.Fprintln(hash, "(request-target):", strings.ToLower(req.Method), req.URL.Path)
-	fmt.Fprintln(hash, "host:", req.URL.Hostname())
-	fmt.Fprintf(hash, "date: %s", date)
-
 	if req.Body != nil {
-		// we're adding one more entry to our signature, so one more line.
-		fmt.Fprint(hash, "\n")
 		buf := &bytes.Buffer{}
 		io.Copy(buf, req.Body)
 		req.Body.Close()
 		req.Body = io.NopCloser(buf)
-		digest := sha256.Sum256(buf.Bytes())
-		d := "SHA-256=" + base64.StdEncoding.EncodeToString(digest[:])
+		req.Header.Set("Digest", digest(buf.Bytes()))
 		toSign = append(toSign, "digest")
-		fmt.Fprintf(hash, "digest: %s", d)
-		req.Header.Set("Digest", d)
 	}
-	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash.Sum(nil))
+	s, err := signingString(req, toSign)
+	if err != nil {
+		return err
+	}
+	sig, err := signMessage(key, []byte(s))
 	if err != nil {
 		return err
 	}
 	bsig := base64.StdEncoding.EncodeToString(sig)
 
-	val := fmt.Sprintf("keyId=%q,algorithm=%q,headers=%q,signature=%q", pubkeyURL, "rsa-sha256", strings.Join(toSign, " "), bsig)
+	algorithm := "hs2019"
+	if _, ok := key.Public().(*rsa.PublicKey); ok {
+		algorithm = "rsa-sha256"
+	}
+	val := fmt.Sprintf("keyId=%q,algorithm=%q,headers=%q,signature=%q", pubkeyURL, algorithm, strings.Join(toSign, " "), bsig)
 	req.Header.Set("Signature", val)
 	return nil
 }
 
+// MaxSignatureAge is the maximum difference between the creation time
+// of a request signature and the current time accepted by Verify.
+var MaxSignatureAge = 12 * time.Hour
+
+// Verify verifies the HTTP signature of req,
+// returning the ID of the key which signed it.
+// Both draft-cavage signatures and RFC 9421 message signatures are
+// understood; RFC 9421 is used if req has a Signature-Input header.
+// The public key is retrieved by calling fetchKey with the key ID
+// from the request's signature.
+// Requests are rejected if the signature is older than MaxSignatureAge,
+// or if the request has a body whose digest is
+// missing, unsigned or does not match the body.
+// RSA and Ed25519 keys are supported.
+func Verify(req *http.Request, fetchKey func(keyID string) (crypto.PublicKey, error)) (keyID string, err error) {
+	if req.Header.Get("Signature-Input") != "" {
+		return verifyRFC9421(req, fetchKey)
+	}
+	return verifyCavage(req, fetchKey)
+}
+
+func verifyCavage(req *http.Request, fetchKey func(keyID string) (crypto.PublicKey, error)) (string, error) {
+	if req.Header.Get("Signature") == "" {
+		return "", fmt.Errorf("missing signature header")
+	}
+	sig, err := parseSignatureHeader(req.Header.Get("Signature"))
+	if err != nil {
+		return "", fmt.Errorf("parse signature header: %w", err)
+	}
+	if sig.algorithm != "rsa-sha256" && sig.algorithm != "ed25519" && sig.algorithm != "hs2019" {
+		return "", fmt.Errorf("unsupported signature algorithm %s", sig.algorithm)
+	}
+	headers := strings.Fields(strings.ToLower(sig.headers))
+	if !contains(headers, "(request-target)") {
+		return "", fmt.Errorf("request target not signed")
+	}
+	if !contains(headers, "date") {
+		return "", fmt.Errorf("date not signed")
+	}
+	date, err := http.ParseTime(req.Header.Get("Date"))
+	if err != nil {
+		return "", fmt.Errorf("parse date: %w", err)
+	}
+	if age := time.Since(date); age > MaxSignatureAge || age < -MaxSignatureAge {
+		return "", fmt.Errorf("date %s outside of accepted range", req.Header.Get("Date"))
+	}
+
+	if req.Body != nil && req.Body != http.NoBody {
+		buf := &bytes.Buffer{}
+		_, err := io.Copy(buf, req.Body)
+		req.Body.Close()
+		req.Body = io.NopCloser(buf)
+		if err != nil {
+			return "", fmt.Errorf("read body: %w", err)
+		}
+		if buf.Len() > 0 {
+			if !contains(headers, "digest") {
+				return "", fmt.Errorf("digest not signed")
+			}
+			if req.Header.Get("Digest") != digest(buf.Bytes()) {
+				return "", fmt.Errorf("digest mismatch")
+			}
+		}
+	}
+
+	s, err := signingString(req, headers)
+	if err != nil {
+		return "", err
+	}
+	bsig, err := base64.StdEncoding.DecodeString(sig.signature)
+	if err != nil {
+		return "", fmt.Errorf("decode signature: %w", err)
+	}
+	pubkey, err := fetchKey(sig.keyID)
+	if err != nil {
+		return "", fmt.Errorf("fetch key %s: %w", sig.keyID, err)
+	}
+	switch pubkey.(type) {
+	case *rsa.PublicKey:
+		if sig.algorithm == "ed25519" {
+			return "", fmt.Errorf("algorithm %s used with rsa key", sig.algorithm)
+		}
+	case ed25519.PublicKey:
+		if sig.algorithm == "rsa-sha256" {
+			return "", fmt.Errorf("algorithm %s used with ed25519 key", sig.algorithm)
+		}
+	}
+	if err := verifyMessage(pubkey, []byte(s), bsig); err != nil {
+		return "", fmt.Errorf("verify signature: %w", err)
+	}
+	return sig.keyID, nil
+}
+
+// signingString returns the string to be signed for req
+// as described in draft-cavage-http-signatures section 2.3.
+func signingString(req *http.Request, headers []string) (string, error) {
+	lines := make([]string, len(headers))
+	for i, h := range headers {
+		switch h {
+		case "(request-target)":
+			lines[i] = fmt.Sprintf("%s: %s %s", h, strings.ToLower(req.Method), req.URL.RequestURI())
+		case "host":
+			lines[i] = h + ": " + requestHost(req)
+		default:
+			v := req.Header.Values(h)
+			if len(v) == 0 {
+				return "", fmt.Errorf("missing signed header %s", h)
+			}
+			lines[i] = fmt.Sprintf("%s: %s", h, strings.Join(v, ", "))
+		}
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// digest returns the value of the Digest header for body.
+// See RFC 3230.
+func digest(body []byte) string {
+	sum := sha256.Sum256(body)
+	return "SHA-256=" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func contains(a []string, s string) bool {
+	for i := range a {
+		if a[i] == s {
+			return true
+		}
+	}
+	return false
+}
+
 type signature struct {
 	keyID     string
 	algorithm string
@@ -62,7 +192,7 @@ type signature struct {
 func parseSignatureHeader(line string) (signature, error) {
 	var sig signature
 	for _, v := range strings.Split(line, ",") {
-		name, val, ok := strings.Cut(v, "=")
+		name, val, ok := strings.Cut(strings.TrimSpace(v), "=")
 		if !ok {
 			return sig, fmt.Errorf("bad field: %s from %s", v, line)
 		}
@@ -76,6 +206,9 @@ func parseSignatureHeader(line string) (signature, error) {
 			sig.headers = val
 		case "signature":
 			sig.signature = val
+		case "created", "expires":
+			// only meaningful with the (created) and (expires)
+			// pseudo-headers, which we do not sign.
 		default:
 			return signature{}, fmt.Errorf("bad field name %s", name)
 		}
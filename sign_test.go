@@ -1,13 +1,21 @@
 package apub
 
 import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
+	"fmt"
+	"io"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"regexp"
 	"strings"
 	"testing"
+	"time"
 )
 
 func readPrivKey(name string) (*rsa.PrivateKey, error) {
@@ -19,6 +27,19 @@ func readPrivKey(name string) (*rsa.PrivateKey, error) {
 	return x509.ParsePKCS1PrivateKey(block.Bytes)
 }
 
+func readPubKey(name string) (*rsa.PublicKey, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	return key.(*rsa.PublicKey), nil
+}
+
 func TestSign(t *testing.T) {
 	req, err := http.NewRequest(http.MethodPost, "http://example.invalid", strings.NewReader("hello, world!"))
 	if err != nil {
@@ -32,3 +53,151 @@ func TestSign(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestVerify(t *testing.T) {
+	key, err := readPrivKey("testdata/private.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubkey, err := readPubKey("testdata/public.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyID := "http://from.invalid/actor#main-key"
+	fetchKey := func(id string) (crypto.PublicKey, error) {
+		if id != keyID {
+			t.Errorf("fetch unexpected key %s", id)
+		}
+		return pubkey, nil
+	}
+
+	tests := []struct {
+		name   string
+		tamper func(req *http.Request)
+		ok     bool
+	}{
+		{"untouched", func(req *http.Request) {}, true},
+		{
+			"body",
+			func(req *http.Request) { req.Body = io.NopCloser(strings.NewReader("goodbye, world!")) },
+			false,
+		},
+		{
+			"path",
+			func(req *http.Request) { req.URL.Path = "/outbox" },
+			false,
+		},
+		{
+			"stale date",
+			func(req *http.Request) {
+				req.Header.Set("Date", time.Now().Add(-2*MaxSignatureAge).UTC().Format(http.TimeFormat))
+			},
+			false,
+		},
+		{
+			"stale created",
+			func(req *http.Request) {
+				created := regexp.MustCompile(`created=\d+`)
+				old := fmt.Sprintf("created=%d", time.Now().Add(-2*MaxSignatureAge).Unix())
+				req.Header.Set("Signature-Input", created.ReplaceAllString(req.Header.Get("Signature-Input"), old))
+			},
+			false,
+		},
+		{
+			"no signature",
+			func(req *http.Request) { req.Header.Del("Signature") },
+			false,
+		},
+		{
+			"method",
+			func(req *http.Request) { req.Method = http.MethodPut },
+			false,
+		},
+	}
+	signers := map[SignatureScheme]func(*http.Request, crypto.Signer, string) error{
+		Cavage:  Sign,
+		RFC9421: SignRFC9421,
+	}
+	// each scheme dates its signatures differently.
+	only := map[string]SignatureScheme{
+		"stale date":    Cavage,
+		"stale created": RFC9421,
+	}
+	for scheme, sign := range signers {
+		for _, tt := range tests {
+			if s, ok := only[tt.name]; ok && s != scheme {
+				continue
+			}
+			req, err := http.NewRequest(http.MethodPost, "https://example.invalid/inbox", strings.NewReader("hello, world!"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := sign(req, key, keyID); err != nil {
+				t.Fatal(err)
+			}
+			tt.tamper(req)
+			got, err := Verify(req, fetchKey)
+			if tt.ok && err != nil {
+				t.Errorf("%s %s: verify: %v", scheme, tt.name, err)
+			} else if !tt.ok && err == nil {
+				t.Errorf("%s %s: verified tampered request", scheme, tt.name)
+			}
+			if tt.ok && got != keyID {
+				t.Errorf("%s %s: want key id %s, got %s", scheme, tt.name, keyID, got)
+			}
+		}
+	}
+}
+
+func TestDoubleKnock(t *testing.T) {
+	key, err := readPrivKey("testdata/private.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Signature-Input") == "" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+	client := &Client{Client: srv.Client(), Key: key, PubKeyID: "http://from.invalid/actor#main-key"}
+	if _, err := client.Send(srv.URL+"/inbox", &Activity{Type: "Note"}); err != nil {
+		t.Errorf("send after retrying with %s: %v", RFC9421, err)
+	}
+}
+
+func TestSchemeKeys(t *testing.T) {
+	key, err := readPrivKey("testdata/private.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edkey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sigs []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		sigs = append(sigs, req.Header.Get("Signature")+req.Header.Get("Signature-Input"))
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer srv.Close()
+	client := &Client{
+		Client:       srv.Client(),
+		Key:          key,
+		PubKeyID:     "http://from.invalid/actor#main-key",
+		RFC9421Key:   edkey,
+		RFC9421KeyID: "http://from.invalid/actor#ed25519-key",
+	}
+	client.Send(srv.URL+"/inbox", &Activity{Type: "Note"})
+	if len(sigs) != 2 {
+		t.Fatalf("want 2 requests, one per scheme, got %d", len(sigs))
+	}
+	if !strings.Contains(sigs[0], client.PubKeyID) || !strings.Contains(sigs[0], "rsa-sha256") {
+		t.Errorf("%s request not signed with rsa key: %s", Cavage, sigs[0])
+	}
+	if !strings.Contains(sigs[1], client.RFC9421KeyID) || !strings.Contains(sigs[1], "ed25519") {
+		t.Errorf("%s request not signed with ed25519 key: %s", RFC9421, sigs[1])
+	}
+}
@@ -1,11 +1,13 @@
 package apub
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"net/http"
 	"net/mail"
+	"net/url"
 	"strings"
-
-	"webfinger.net/go/webfinger"
 )
 
 // Finger wraps defaultClient.Finger.
@@ -17,19 +19,75 @@ func Finger(address string) (*Actor, error) {
 // if any, of an address resolvable by WebFinger.
 // It is equivalent to doing webfinger.Lookup then LookupActor.
 func (c *Client) Finger(address string) (*Actor, error) {
-	jrd, err := webfinger.Lookup(address, nil)
+	return c.FingerContext(context.Background(), address)
+}
+
+// FingerContext is like Finger but uses ctx for the underlying HTTP requests.
+func (c *Client) FingerContext(ctx context.Context, address string) (*Actor, error) {
+	jrd, err := c.webfinger(ctx, address)
 	if err != nil {
 		return nil, err
 	}
 	for i := range jrd.Links {
 		if jrd.Links[i].Type == ContentType {
-			return c.LookupActor(jrd.Links[i].Href)
+			return c.LookupActorContext(ctx, jrd.Links[i].Href)
 		}
 	}
 	return nil, ErrNotExist
 }
 
-func (c *Client) fingerAll(alist []*mail.Address) ([]Actor, error) {
+// jrd is a JSON Resource Descriptor.
+// See RFC 7033 section 4.4.
+type jrd struct {
+	Subject string `json:"subject"`
+	Links   []struct {
+		Rel  string `json:"rel"`
+		Type string `json:"type"`
+		Href string `json:"href"`
+	} `json:"links"`
+}
+
+// webfinger looks up the acct resource for address
+// as described in RFC 7033.
+func (c *Client) webfinger(ctx context.Context, address string) (*jrd, error) {
+	address = strings.TrimPrefix(address, "acct:")
+	address = strings.TrimPrefix(address, "@")
+	i := strings.LastIndex(address, "@")
+	if i < 0 {
+		return nil, fmt.Errorf("missing @ in address %s", address)
+	}
+	u := url.URL{
+		Scheme:   "https",
+		Host:     address[i+1:],
+		Path:     "/.well-known/webfinger",
+		RawQuery: url.Values{"resource": []string{"acct:" + address}}.Encode(),
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/jrd+json")
+	if c.Client == nil {
+		c.Client = http.DefaultClient
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNotExist
+	} else if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("non-ok response status %s", resp.Status)
+	}
+	var j jrd
+	if err := json.NewDecoder(resp.Body).Decode(&j); err != nil {
+		return nil, fmt.Errorf("decode jrd: %w", err)
+	}
+	return &j, nil
+}
+
+func (c *Client) fingerAll(ctx context.Context, alist []*mail.Address) ([]Actor, error) {
 	actors := make([]Actor, len(alist))
 	for i, addr := range alist {
 		q := addr.Address
@@ -37,7 +95,7 @@ func (c *Client) fingerAll(alist []*mail.Address) ([]Actor, error) {
 			// strip "+followers" to get the regular address that can be fingered.
 			q = strings.Replace(addr.Address, "+followers", "", 1)
 		}
-		actor, err := c.Finger(q)
+		actor, err := c.FingerContext(ctx, q)
 		if err != nil {
 			return actors, fmt.Errorf("finger %s: %w", q, err)
 		}